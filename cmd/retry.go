@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"firehose/pkg/api"
+	"firehose/pkg/core"
+	"firehose/pkg/utils"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	retryClasses   []string
+	retryOlderThan time.Duration
+	retryNewerThan time.Duration
+)
+
+var retryCmd = &cobra.Command{
+	Use:   "retry <directory>",
+	Short: "Retry downloads that failed and were recorded in the dead letters of a directory.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		directory := args[0]
+		if _, err := os.Stat(directory); err != nil {
+			slog.Error("Directory does not exist", "error", err)
+			return
+		}
+		for _, class := range retryClasses {
+			if !slices.Contains(core.FailureClasses, class) {
+				slog.Error("Unknown failure class", "class", class)
+				return
+			}
+		}
+
+		f, err := utils.MakeLogFile(directory)
+		if err != nil {
+			slog.Error("Error creating log file", "error", err)
+			return
+		}
+		defer f.Close()
+		utils.SetupLogger(f)
+
+		httpClient, err := configureHTTP()
+		if err != nil {
+			slog.Error("Error configuring HTTP client", "error", err)
+			return
+		}
+		FSClient, layout, err := configureFiles()
+		if err != nil {
+			slog.Error("Error configuring file writes", "error", err)
+			return
+		}
+		APIClient := &api.DefaultAPIClient{
+			Hosts:      utils.NewPDSCache(&utils.DefaultDIDResolver{PLCURL: plcDirectory, HTTPClient: httpClient}, time.Duration(identityTTL)*time.Second),
+			HTTPClient: httpClient,
+		}
+
+		store := core.NewDeadLetterStore(FSClient, filepath.Join(directory, core.DeadLetterFilename))
+		letters, err := store.Load()
+		if err != nil {
+			slog.Error("Error loading dead letters", "error", err)
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		DownloadClient, err := newDownloadClient(FSClient, directory, layout)
+		if err != nil {
+			slog.Error("Error opening blob store", "error", err)
+			return
+		}
+
+		index, err := core.OpenRecordIndex(FSClient, directory)
+		if err != nil {
+			slog.Error("Error opening record index", "error", err)
+			return
+		}
+
+		filter := &core.DeadLetterFilter{Classes: retryClasses, OlderThan: retryOlderThan, NewerThan: retryNewerThan}
+		remaining, retried, recovered := retryDeadLetters(ctx, DownloadClient, APIClient, FSClient, index, letters, filter)
+		if err := store.Replace(remaining); err != nil {
+			slog.Error("Error saving dead letters", "error", err)
+		}
+		fmt.Printf("Retried %d of %d dead letters: %d recovered, %d remaining\n", retried, len(letters), recovered, len(remaining))
+	},
+}
+
+func retryDeadLetters(ctx context.Context, DownloadClient core.DownloadClient, APIClient api.APIClient, FSClient utils.FileSystem, index *core.RecordIndex, letters []*core.DeadLetter, filter *core.DeadLetterFilter) ([]*core.DeadLetter, int, int) {
+	remaining := []*core.DeadLetter{}
+	retried, recovered := 0, 0
+	now := time.Now().UTC()
+	for _, letter := range letters {
+		if ctx.Err() != nil || !filter.Matches(letter, now) {
+			remaining = append(remaining, letter)
+			continue
+		}
+		retried++
+		slog.Info("retrying dead letter", "path", letter.Path, "did", letter.Repo, "aturi", letter.AtUri, "class", letter.Class, "attempts", letter.Attempts)
+		archived, err := core.ArchivePost(ctx, DownloadClient, APIClient, FSClient, letter.RepoOp(), letter.Directory)
+		if err != nil {
+			if ctx.Err() == nil {
+				letter.Failed(err, time.Now().UTC())
+			}
+			remaining = append(remaining, letter)
+			continue
+		}
+		recovered++
+		if err := index.Add(core.NewIndexEntry(letter.Repo, letter.Path, archived, time.Now().UTC())); err != nil {
+			slog.Error("Error indexing archived record", "error", err, "path", letter.Path, "did", letter.Repo)
+		}
+	}
+	return remaining, retried, recovered
+}
+
+func init() {
+	rootCmd.AddCommand(retryCmd)
+	retryCmd.Flags().StringSliceVar(&retryClasses, "class", nil, "Only retry failures of these classes (deleted, auth, rejected, rate-limited, transient)")
+	retryCmd.Flags().DurationVar(&retryOlderThan, "older-than", 0, "Only retry failures that last failed longer ago than this, e.g. 1h")
+	retryCmd.Flags().DurationVar(&retryNewerThan, "newer-than", 0, "Only retry failures that last failed within this duration, e.g. 24h")
+}
@@ -9,20 +9,46 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
-	"github.com/bluesky-social/indigo/events"
-	"github.com/bluesky-social/indigo/events/schedulers/sequential"
 	"github.com/gorilla/websocket"
 	"github.com/spf13/cobra"
 )
 
-const (
-	MAX_WORKERS = 4
-)
-
 var (
-	handle string
+	handles         []string
+	handlesFile     string
+	collections     []string
+	stateFile       string
+	cursorFlag      int64
+	idleTimeout     int
+	relay           string
+	pds             bool
+	source          string
+	jetstream       string
+	compress        bool
+	zstdDictionary  string
+	plcDirectory    string
+	identityTTL     int
+	pauseInactive   bool
+	shutdownTimeout int
+	workers         int
+	queueSize       int
+	queueFile       string
+	proxy           string
+	rateLimit       float64
+	onConflict      string
+	blobStore       bool
+	blobLink        string
+	onDelete        string
+	pathTemplate    string
+	sanitize        string
+	stripEmoji      bool
+	maxPath         int
+	altText         bool
 )
 
 var rootCmd = &cobra.Command{
@@ -44,36 +70,291 @@ var rootCmd = &cobra.Command{
 		defer f.Close()
 		utils.SetupLogger(f)
 
-		uri := "wss://bsky.network/xrpc/com.atproto.sync.subscribeRepos"
-		con, _, err := websocket.DefaultDialer.Dial(uri, http.Header{})
+		registry, err := core.SelectCollections(collections)
 		if err != nil {
-			slog.Error("WebSocket dial error", "error", err)
+			slog.Error("Error selecting collections", "error", err)
 			return
 		}
 
-		client := utils.DefaultHandleResolver{}
-		did, err := utils.ResolveHandle(&client, handle)
+		if stateFile == "" {
+			stateFile = filepath.Join(directory, core.CursorFilename)
+		}
+		cursor, err := core.LoadCursor(stateFile)
 		if err != nil {
-			slog.Error("Error resolving handle", "error", err)
+			slog.Error("Error loading cursor", "error", err)
 			return
 		}
+		if cmd.Flags().Changed("cursor") {
+			cursor.Reset(cursorFlag)
+		}
 
-		fmt.Println("Now subscribed to:", handle)
+		if seq := cursor.Seq(); seq >= 0 {
+			slog.Info("resuming from cursor", "cursor", seq, "state-file", stateFile)
+		}
 
-		semaphore := make(chan struct{}, MAX_WORKERS)
-		var wg sync.WaitGroup
+		httpClient, err := configureHTTP()
+		if err != nil {
+			slog.Error("Error configuring HTTP client", "error", err)
+			return
+		}
+		FSClient, layout, err := configureFiles()
+		if err != nil {
+			slog.Error("Error configuring file writes", "error", err)
+			return
+		}
 
-		APIClient := api.DefaultAPIClient{}
-		FSClient := utils.DefaultFileSystem{}
-		DownlaodClient := core.DefaultDownloadClient{}
+		didResolver := &utils.DefaultDIDResolver{PLCURL: plcDirectory, HTTPClient: httpClient}
+		pdsCache := utils.NewPDSCache(didResolver, time.Duration(identityTTL)*time.Second)
 
-		rsc := core.RepoCommit(did, directory, &APIClient, &FSClient, &DownlaodClient, &semaphore, &wg)
+		handleResolver := &utils.DefaultHandleResolver{HTTPClient: httpClient}
+		identities := &utils.DefaultIdentityResolver{Handles: handleResolver, DIDs: didResolver, PDS: pdsCache}
+		accounts, err := resolveAccounts(directory, handleResolver, didResolver, identities)
+		if err != nil {
+			slog.Error("Error resolving accounts", "error", err)
+			return
+		}
 
-		sched := sequential.NewScheduler("myfirehose", rsc.EventHandler)
-		events.HandleRepoStream(context.Background(), con, sched, slog.Default())
+		if queueFile == "" {
+			queueFile = filepath.Join(directory, core.QueueFilename)
+		}
+		queue, err := core.OpenQueue(FSClient, queueFile, queueSize)
+		if err != nil {
+			slog.Error("Error opening queue", "error", err)
+			return
+		}
+		defer queue.Close()
+
+		DownloadClient, err := newDownloadClient(FSClient, directory, layout)
+		if err != nil {
+			slog.Error("Error opening blob store", "error", err)
+			return
+		}
+		DownloadClient.Collections = registry
+		deletePolicy, err := core.ParseDeletePolicy(onDelete)
+		if err != nil {
+			slog.Error("Error selecting delete policy", "error", err)
+			return
+		}
+		index, err := core.OpenRecordIndex(FSClient, directory)
+		if err != nil {
+			slog.Error("Error opening record index", "error", err)
+			return
+		}
+		APIClient := api.DefaultAPIClient{Hosts: pdsCache, HTTPClient: httpClient}
+
+		archiver := core.NewArchiver(accounts, &APIClient, FSClient, DownloadClient, registry, queue, workers).
+			FollowIdentity(identities, pauseInactive).
+			WithDeadLetters(core.NewDeadLetterStore(FSClient, filepath.Join(directory, core.DeadLetterFilename))).
+			WithRecordIndex(index.WithBlobStore(DownloadClient.Blobs), deletePolicy)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go cursor.FlushEvery(ctx, 5*time.Second)
+		go logStats(ctx, accounts, queue)
+
+		eventSource, err := newEventSource(ctx, archiver, registry, cursor, accounts, pdsCache)
+		if err != nil {
+			slog.Error("Error creating event source", "error", err)
+			return
+		}
+		err = eventSource.Run(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Event stream closed", "error", err)
+		}
+		stop()
+
+		timeout := time.Duration(shutdownTimeout) * time.Second
+		fmt.Println("Shutting down, waiting up to", timeout, "for in-flight downloads")
+		slog.Info("shutting down, draining in-flight downloads", "timeout", timeout)
+		remaining := archiver.Shutdown(timeout)
+		if len(remaining) > 0 {
+			slog.Warn("unfinished downloads were kept in the queue journal", "count", len(remaining), "queue-file", queueFile)
+		}
+		if err := queue.Close(); err != nil {
+			slog.Error("Error closing queue", "error", err)
+		}
+		if err := cursor.Flush(); err != nil {
+			slog.Error("Error flushing cursor", "error", err)
+		}
+		accounts.LogStats()
+		queue.LogStats()
 	},
 }
 
+func resolveAccounts(directory string, handleResolver utils.HandleResolver, didResolver utils.DIDResolver, identities core.IdentityResolver) (*core.Accounts, error) {
+	all := append([]string{}, handles...)
+	if handlesFile != "" {
+		fromFile, err := utils.ReadHandlesFile(handlesFile)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, fromFile...)
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("at least one --handle or a --handles-file is required")
+	}
+
+	var accounts []*core.Account
+	seen := map[string]bool{}
+	for _, input := range all {
+		did, err := utils.ResolveHandle(handleResolver, didResolver, input)
+		if err != nil {
+			return nil, fmt.Errorf("%w The handle: %s", err, input)
+		}
+		if seen[did] {
+			continue
+		}
+		seen[did] = true
+
+		handle := accountHandle(identities, did)
+		account := &core.Account{Did: did, Handle: handle, Directory: directory}
+		if len(all) > 1 {
+			account.Root = directory
+			account.Directory = core.AccountDirectory(directory, handle)
+			if err := os.MkdirAll(account.Directory, 0755); err != nil {
+				return nil, err
+			}
+		}
+		accounts = append(accounts, account)
+		fmt.Println("Now subscribed to:", handle)
+	}
+	return core.NewAccounts(accounts...), nil
+}
+
+func accountHandle(identities core.IdentityResolver, did string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), core.IdentityTimeout)
+	defer cancel()
+	handle, err := identities.ResolveIdentity(ctx, did)
+	if err != nil || handle == utils.InvalidHandle {
+		slog.Warn("could not verify the account handle, naming it after its DID", "did", did, "handle", handle, "error", err)
+		return did
+	}
+	return handle
+}
+
+func logStats(ctx context.Context, accounts *core.Accounts, queue *core.Queue) {
+	t := time.NewTicker(10 * time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			accounts.LogStats()
+			queue.LogStats()
+		}
+	}
+}
+
+func resolveHosts(ctx context.Context, accounts *core.Accounts, pdsCache *utils.PDSCache) []string {
+	hosts := []string{relay}
+	if !pds {
+		return hosts
+	}
+	endpoint := ""
+	for _, did := range accounts.Dids() {
+		accountEndpoint, err := pdsCache.PDS(ctx, did)
+		if err != nil {
+			slog.Error("Error resolving PDS, falling back to relay", "error", err, "did", did, "relay", relay)
+			return hosts
+		}
+		if endpoint != "" && endpoint != accountEndpoint {
+			slog.Warn("Accounts are hosted on different PDSes, falling back to relay", "relay", relay)
+			return hosts
+		}
+		endpoint = accountEndpoint
+	}
+	slog.Info("subscribing to PDS", "pds", endpoint)
+	return []string{core.WebsocketHost(endpoint), relay}
+}
+
+func newEventSource(ctx context.Context, archiver *core.Archiver, registry *core.CollectionRegistry, cursor *core.Cursor, accounts *core.Accounts, pdsCache *utils.PDSCache) (core.EventSource, error) {
+	switch source {
+	case "firehose":
+		hosts := resolveHosts(ctx, accounts, pdsCache)
+		return &core.Firehose{
+			Hosts:       hosts,
+			Cursor:      cursor,
+			Dialer:      websocketDialer(),
+			Handler:     core.TrackCursor(cursor, archiver.EventHandler),
+			IdleTimeout: time.Duration(idleTimeout) * time.Second,
+		}, nil
+	case "jetstream":
+		var dictionary []byte
+		if compress {
+			if zstdDictionary == "" {
+				return nil, fmt.Errorf("--compress requires --zstd-dictionary")
+			}
+			var err error
+			dictionary, err = core.LoadZstdDictionary(zstdDictionary)
+			if err != nil {
+				return nil, err
+			}
+		}
+		wantedCollections := []string{}
+		for _, collection := range registry.Collections() {
+			wantedCollections = append(wantedCollections, collection.String())
+		}
+		return &core.Jetstream{
+			Hosts:             []string{jetstream},
+			Cursor:            cursor,
+			Dialer:            websocketDialer(),
+			Handler:           archiver.JetstreamEvent,
+			WantedDids:        accounts.Dids(),
+			WantedCollections: wantedCollections,
+			Dictionary:        dictionary,
+			IdleTimeout:       time.Duration(idleTimeout) * time.Second,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown event source: %s", source)
+	}
+}
+
+func configureHTTP() (*http.Client, error) {
+	return api.NewHTTPClient(api.HTTPOptions{Proxy: proxy, RateLimit: rateLimit})
+}
+
+func configureFiles() (*utils.DefaultFileSystem, *utils.PathTemplate, error) {
+	policy, err := utils.ParseConflictPolicy(onConflict)
+	if err != nil {
+		return nil, nil, err
+	}
+	layout, err := utils.ParsePathTemplate(pathTemplate)
+	if err != nil {
+		return nil, nil, err
+	}
+	profile, err := utils.ParseSanitizeProfile(sanitize)
+	if err != nil {
+		return nil, nil, err
+	}
+	sanitizer := utils.NewSanitizer(profile)
+	sanitizer.StripEmoji = stripEmoji
+	if maxPath > 0 {
+		sanitizer.MaxPathBytes = maxPath
+	}
+	layout.Sanitizer = sanitizer
+	return &utils.DefaultFileSystem{OnConflict: policy}, layout, nil
+}
+
+func newDownloadClient(FSClient utils.FileSystem, directory string, layout *utils.PathTemplate) (*core.DefaultDownloadClient, error) {
+	if !blobStore {
+		return &core.DefaultDownloadClient{Layout: layout, AltText: altText}, nil
+	}
+	store, err := core.OpenBlobStore(FSClient, directory, blobLink)
+	if err != nil {
+		return nil, err
+	}
+	return &core.DefaultDownloadClient{Blobs: store, Layout: layout, AltText: altText}, nil
+}
+
+func websocketDialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	if proxyFunc, err := api.ProxyFunc(proxy); err == nil {
+		dialer.Proxy = proxyFunc
+	}
+	return &dialer
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		slog.Error("Error executing command", "error", err)
@@ -82,6 +363,34 @@ func Execute() {
 }
 
 func init() {
-	rootCmd.PersistentFlags().StringVar(&handle, "handle", "", "Handle of the desired account")
-	rootCmd.MarkPersistentFlagRequired("handle")
+	rootCmd.PersistentFlags().StringArrayVar(&handles, "handle", nil, "Handle of the desired account, may be repeated")
+	rootCmd.PersistentFlags().StringVar(&handlesFile, "handles-file", "", "File with one handle per line to subscribe to")
+	rootCmd.PersistentFlags().StringSliceVar(&collections, "collections", []string{"like", "repost", "post"}, "Collections to archive (like, repost, post)")
+	rootCmd.PersistentFlags().StringVar(&stateFile, "state-file", "", "File to persist the firehose cursor in (default <directory>/fw.cursor)")
+	rootCmd.PersistentFlags().Int64Var(&cursorFlag, "cursor", -1, "Firehose sequence number to replay from, overriding the stored cursor")
+	rootCmd.PersistentFlags().IntVar(&idleTimeout, "idle-timeout", 60, "Seconds without firehose frames before forcing a reconnect")
+	rootCmd.PersistentFlags().StringVar(&relay, "relay", "wss://bsky.network", "Relay firehose host to subscribe to")
+	rootCmd.PersistentFlags().BoolVar(&pds, "pds", false, "Subscribe to the account's PDS directly, falling back to the relay")
+	rootCmd.PersistentFlags().StringVar(&source, "source", "firehose", "Event source to consume (firehose, jetstream)")
+	rootCmd.PersistentFlags().StringVar(&jetstream, "jetstream", "wss://jetstream2.us-east.bsky.network", "Jetstream host to subscribe to when --source is jetstream")
+	rootCmd.PersistentFlags().BoolVar(&compress, "compress", false, "Request zstd compressed events from Jetstream")
+	rootCmd.PersistentFlags().StringVar(&zstdDictionary, "zstd-dictionary", "", "Path to the Jetstream zstd dictionary, required by --compress")
+	rootCmd.PersistentFlags().StringVar(&plcDirectory, "plc-directory", utils.DefaultPLCURL, "PLC directory used to resolve did:plc identities")
+	rootCmd.PersistentFlags().IntVar(&identityTTL, "identity-ttl", 3600, "Seconds to cache the PDS resolved from a DID document")
+	rootCmd.PersistentFlags().BoolVar(&pauseInactive, "pause-inactive", false, "Stop archiving an account while it is deactivated, suspended or taken down")
+	rootCmd.PersistentFlags().IntVar(&shutdownTimeout, "shutdown-timeout", 30, "Seconds to wait for in-flight downloads on shutdown before cancelling them")
+	rootCmd.PersistentFlags().IntVar(&workers, "workers", 4, "Number of posts to download concurrently")
+	rootCmd.PersistentFlags().IntVar(&queueSize, "queue-size", 1000, "Number of queued downloads before the event stream is paused")
+	rootCmd.PersistentFlags().StringVar(&queueFile, "queue-file", "", "File to journal queued downloads in (default <directory>/fw.queue.jsonl)")
+	rootCmd.PersistentFlags().StringVar(&proxy, "proxy", "", "Proxy URL for all connections (default taken from HTTPS_PROXY)")
+	rootCmd.PersistentFlags().Float64Var(&rateLimit, "rate-limit", api.DefaultRateLimit, "Maximum requests per second to each host, 0 for unlimited")
+	rootCmd.PersistentFlags().StringVar(&onConflict, "on-conflict", string(utils.ConflictOverwrite), "What to do when a file already exists (skip, overwrite, suffix, version)")
+	rootCmd.PersistentFlags().BoolVar(&altText, "alt-text", false, "Also write the alt text of every image and video to a .txt file next to it")
+	rootCmd.PersistentFlags().BoolVar(&blobStore, "blob-store", false, "Store each blob once under <directory>/blobs/<cid>.<ext> and link it into post directories")
+	rootCmd.PersistentFlags().StringVar(&blobLink, "blob-link", core.LinkHard, "How blobs in the blob store are linked into post directories (hard, symbolic)")
+	rootCmd.PersistentFlags().StringVar(&pathTemplate, "path-template", utils.DefaultPathTemplate, "Template for the path of each archived file, relative to the output directory")
+	rootCmd.PersistentFlags().StringVar(&sanitize, "sanitize", string(utils.DefaultSanitizeProfile()), "Which file systems file names must be valid on (posix, windows, portable, ascii)")
+	rootCmd.PersistentFlags().BoolVar(&stripEmoji, "strip-emoji", false, "Remove emoji from file names")
+	rootCmd.PersistentFlags().IntVar(&maxPath, "max-path", 0, "Maximum length of a full file path in bytes. Defaults to 260 for the windows, portable and ascii profiles and 4096 for posix")
+	rootCmd.PersistentFlags().StringVar(&onDelete, "on-delete", core.DeleteKeep, "What to do with archived files when a like, repost or post is deleted (keep, move, remove)")
 }
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"firehose/pkg/core"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyQuarantine bool
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <directory>",
+	Short: "Re-check every downloaded blob in a directory against the CIDs recorded in its post metadata.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		directory := args[0]
+		if _, err := os.Stat(directory); err != nil {
+			slog.Error("Directory does not exist", "error", err)
+			return
+		}
+		FSClient, layout, err := configureFiles()
+		if err != nil {
+			slog.Error("Error configuring file writes", "error", err)
+			return
+		}
+
+		checks, err := core.VerifyArchive(FSClient, layout, directory, verifyQuarantine)
+		if err != nil {
+			slog.Error("Error verifying directory", "error", err)
+			return
+		}
+
+		counts := map[string]int{}
+		for _, check := range checks {
+			counts[check.Status]++
+			switch {
+			case check.Quarantined != "":
+				fmt.Printf("%s: %s (CID %s), moved to %s\n", check.Status, check.Path, check.Cid, check.Quarantined)
+			case check.Status != core.BlobOK:
+				fmt.Printf("%s: %s (CID %s)\n", check.Status, check.Path, check.Cid)
+			}
+		}
+		fmt.Printf("Verified %d blobs: %d ok, %d missing, %d mismatched\n", len(checks), counts[core.BlobOK], counts[core.BlobMissing], counts[core.BlobMismatch])
+		if counts[core.BlobMismatch] > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().BoolVar(&verifyQuarantine, "quarantine", false, "Move blobs that do not match their CID into the fw.quarantine directory next to them")
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"firehose/pkg/utils"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+var ErrCIDMismatch = errors.New("blob does not match its CID")
+
+var blobLocks utils.KeyedMutex
+
+type BlobStream struct {
+	Body   io.ReadCloser
+	Offset int64
+	Length int64
+}
+
+func (d *DefaultAPIClient) SyncGetBlobStream(ctx context.Context, client *xrpc.Client, cid, repo string, offset int64) (*BlobStream, error) {
+	params := url.Values{}
+	params.Set("did", repo)
+	params.Set("cid", cid)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Host+"/xrpc/com.atproto.sync.getBlob?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	httpClient := client.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return &BlobStream{Body: res.Body, Offset: 0, Length: res.ContentLength}, nil
+	case http.StatusPartialContent:
+		return &BlobStream{Body: res.Body, Offset: offset, Length: res.ContentLength}, nil
+	}
+	defer res.Body.Close()
+	return nil, xrpcErrorFromResponse(res)
+}
+
+func DownloadBlob(ctx context.Context, client APIClient, fs utils.FileSystem, repo, cidStr, path string) error {
+	parsed, err := cid.Decode(cidStr)
+	if err != nil {
+		return &Error{Class: ErrorRejected, Err: fmt.Errorf("invalid blob CID: %w The CID: %s", err, cidStr)}
+	}
+	unlock := blobLocks.Lock(path)
+	defer unlock()
+	_, err = retry(ctx, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, downloadBlobAttempt(ctx, client, fs, repo, parsed, path)
+	})
+	return err
+}
+
+func downloadBlobAttempt(ctx context.Context, client APIClient, fs utils.FileSystem, repo string, blobCid cid.Cid, path string) error {
+	xrpcClient, err := client.PDSClient(ctx, repo)
+	if err != nil {
+		return err
+	}
+	part, err := utils.OpenPartial(fs, path)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	offset := part.Size()
+	stream, err := client.SyncGetBlobStream(ctx, xrpcClient, blobCid.String(), repo, offset)
+	var xrpcErr *xrpc.Error
+	if offset > 0 && errors.As(err, &xrpcErr) && xrpcErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return commitExisting(part, blobCid)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Body.Close()
+
+	if stream.Offset != offset {
+		if offset > 0 {
+			slog.Info("PDS does not support resuming blob downloads, restarting", "cid", blobCid.String(), "offset", offset)
+		}
+		if err := part.Reset(); err != nil {
+			return err
+		}
+	} else if offset > 0 {
+		slog.Info("resuming blob download", "cid", blobCid.String(), "offset", offset)
+	}
+
+	hasher, err := newCIDHasher(blobCid)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, part.Existing()); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(part, hasher), stream.Body); err != nil {
+		return fmt.Errorf("error streaming blob: %w The CID: %s", err, blobCid)
+	}
+
+	if !hasher.matches() {
+		return quarantine(part, blobCid)
+	}
+	return part.Commit()
+}
+
+func commitExisting(part *utils.PartialFile, blobCid cid.Cid) error {
+	hasher, err := newCIDHasher(blobCid)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, part.Existing()); err != nil {
+		return err
+	}
+	if hasher.matches() {
+		return part.Commit()
+	}
+	return quarantine(part, blobCid)
+}
+
+func quarantine(part *utils.PartialFile, blobCid cid.Cid) error {
+	dest, err := part.Quarantine()
+	if err != nil {
+		slog.Error("error quarantining corrupt blob", "error", err, "cid", blobCid.String())
+	} else {
+		slog.Warn("blob does not match its CID, quarantined", "cid", blobCid.String(), "path", dest)
+	}
+	return fmt.Errorf("%w The CID: %s", ErrCIDMismatch, blobCid)
+}
+
+func VerifyBlob(r io.Reader, cidStr string) error {
+	parsed, err := cid.Decode(cidStr)
+	if err != nil {
+		return fmt.Errorf("invalid blob CID: %w The CID: %s", err, cidStr)
+	}
+	hasher, err := newCIDHasher(parsed)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return err
+	}
+	if !hasher.matches() {
+		return fmt.Errorf("%w The CID: %s", ErrCIDMismatch, parsed)
+	}
+	return nil
+}
+
+type cidHasher struct {
+	hash.Hash
+	digest []byte
+}
+
+func newCIDHasher(blobCid cid.Cid) (*cidHasher, error) {
+	decoded, err := multihash.Decode(blobCid.Hash())
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := multihash.GetHasher(decoded.Code)
+	if err != nil {
+		return nil, err
+	}
+	return &cidHasher{Hash: hasher, digest: decoded.Digest}, nil
+}
+
+func (h *cidHasher) matches() bool {
+	sum := h.Sum(nil)
+	return len(sum) >= len(h.digest) && bytes.Equal(sum[:len(h.digest)], h.digest)
+}
+
+func xrpcErrorFromResponse(res *http.Response) error {
+	xrpcErr := &xrpc.Error{StatusCode: res.StatusCode}
+	var xe xrpc.XRPCError
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&xe); err != nil {
+		xrpcErr.Wrapped = fmt.Errorf("failed to decode xrpc error message: %w", err)
+	} else {
+		xrpcErr.Wrapped = &xe
+	}
+	if res.Header.Get("ratelimit-limit") != "" {
+		xrpcErr.Ratelimit = &xrpc.RatelimitInfo{Policy: res.Header.Get("ratelimit-policy")}
+		if n, err := strconv.ParseInt(res.Header.Get("ratelimit-reset"), 10, 64); err == nil {
+			xrpcErr.Ratelimit.Reset = time.Unix(n, 0)
+		}
+		if n, err := strconv.Atoi(res.Header.Get("ratelimit-limit")); err == nil {
+			xrpcErr.Ratelimit.Limit = n
+		}
+		if n, err := strconv.Atoi(res.Header.Get("ratelimit-remaining")); err == nil {
+			xrpcErr.Ratelimit.Remaining = n
+		}
+	}
+	return xrpcErr
+}
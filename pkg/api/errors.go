@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/cenkalti/backoff/v5"
+)
+
+type ErrorClass string
+
+const (
+	ErrorNotFound    ErrorClass = "not-found"
+	ErrorAuth        ErrorClass = "auth"
+	ErrorRejected    ErrorClass = "rejected"
+	ErrorRateLimited ErrorClass = "rate-limited"
+	ErrorTransient   ErrorClass = "transient"
+	MaxRetryAfter               = 5 * time.Minute
+)
+
+type Error struct {
+	Class      ErrorClass
+	StatusCode int
+	RetryAfter time.Duration
+	Attempts   int
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Err)
+}
+
+func (e *Error) Unwrap() []error {
+	if e.RetryAfter > 0 {
+		return []error{e.Err, &backoff.RetryAfterError{Duration: e.RetryAfter}}
+	}
+	return []error{e.Err}
+}
+
+func (e *Error) Permanent() bool {
+	return e.Class == ErrorNotFound || e.Class == ErrorAuth || e.Class == ErrorRejected
+}
+
+func ClassOf(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Class
+	}
+	return Classify(err).Class
+}
+
+func AttemptsOf(err error) int {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Attempts
+	}
+	return 0
+}
+
+func Classify(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	classified := &Error{Class: ErrorTransient, Err: err}
+	var xrpcErr *xrpc.Error
+	if !errors.As(err, &xrpcErr) {
+		return classified
+	}
+	classified.StatusCode = xrpcErr.StatusCode
+	switch {
+	case xrpcErr.StatusCode == http.StatusUnauthorized || xrpcErr.StatusCode == http.StatusForbidden:
+		classified.Class = ErrorAuth
+	case xrpcErr.StatusCode == http.StatusTooManyRequests:
+		classified.Class = ErrorRateLimited
+	case xrpcErr.StatusCode == http.StatusRequestTimeout:
+		classified.Class = ErrorTransient
+	case xrpcErr.StatusCode == http.StatusNotFound || isNotFoundError(xrpcErr):
+		classified.Class = ErrorNotFound
+	case xrpcErr.StatusCode >= 400 && xrpcErr.StatusCode < 500:
+		classified.Class = ErrorRejected
+	}
+	if xrpcErr.Ratelimit != nil && !xrpcErr.Ratelimit.Reset.IsZero() && (classified.Class == ErrorRateLimited || xrpcErr.Ratelimit.Remaining == 0) {
+		classified.RetryAfter = time.Until(xrpcErr.Ratelimit.Reset)
+	}
+	return classified
+}
+
+func isNotFoundError(xrpcErr *xrpc.Error) bool {
+	if xrpcErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	var body *xrpc.XRPCError
+	if !errors.As(xrpcErr.Wrapped, &body) {
+		return false
+	}
+	return body.ErrStr == "RecordNotFound" || body.ErrStr == "BlobNotFound"
+}
+
+type retryHintKey struct{}
+
+type retryHint struct {
+	retryAfter time.Duration
+}
+
+type retryHintTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryHintTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	if hint, ok := req.Context().Value(retryHintKey{}).(*retryHint); ok {
+		hint.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	}
+	return res, nil
+}
+
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func retry[T any](ctx context.Context, operation func(ctx context.Context) (T, error)) (T, error) {
+	attempts := 0
+	res, err := backoff.Retry(ctx, func() (T, error) {
+		attempts++
+		hint := &retryHint{}
+		res, err := operation(context.WithValue(ctx, retryHintKey{}, hint))
+		if err == nil {
+			return res, nil
+		}
+		classified := Classify(err)
+		classified.Attempts = attempts
+		if hint.retryAfter > 0 {
+			classified.RetryAfter = hint.retryAfter
+		}
+		classified.RetryAfter = min(max(classified.RetryAfter, 0), MaxRetryAfter)
+		if classified.Permanent() {
+			return res, backoff.Permanent(classified)
+		}
+		return res, classified
+	}, backoff.WithBackOff(NewBackOff()), MaxRetries, Notify)
+
+	var permanent *backoff.PermanentError
+	if errors.As(err, &permanent) {
+		return res, permanent.Err
+	}
+	return res, err
+}
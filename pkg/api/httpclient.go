@@ -0,0 +1,104 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	DialTimeout           = 10 * time.Second
+	TLSHandshakeTimeout   = 10 * time.Second
+	ResponseHeaderTimeout = 30 * time.Second
+	RequestTimeout        = 5 * time.Minute
+	DefaultRateLimit      = 5.0
+)
+
+type HTTPOptions struct {
+	Proxy     string
+	RateLimit float64
+}
+
+func NewHTTPClient(opts HTTPOptions) (*http.Client, error) {
+	proxy, err := ProxyFunc(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   TLSHandshakeTimeout,
+		ResponseHeaderTimeout: ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &http.Client{
+		Timeout: RequestTimeout,
+		Transport: &retryHintTransport{
+			base: NewRateLimitTransport(transport, opts.RateLimit),
+		},
+	}, nil
+}
+
+func ProxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %s", proxy)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+type RateLimitTransport struct {
+	base     http.RoundTripper
+	limit    rate.Limit
+	burst    int
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func NewRateLimitTransport(base http.RoundTripper, requestsPerSecond float64) *RateLimitTransport {
+	limit := rate.Inf
+	burst := 1
+	if requestsPerSecond > 0 {
+		limit = rate.Limit(requestsPerSecond)
+		burst = max(1, int(requestsPerSecond))
+	}
+	return &RateLimitTransport{
+		base:     base,
+		limit:    limit,
+		burst:    burst,
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter(req.URL.Host).Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (t *RateLimitTransport) limiter(host string) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	limiter, ok := t.limiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(t.limit, t.burst)
+		t.limiters[host] = limiter
+	}
+	return limiter
+}
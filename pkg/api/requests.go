@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"log/slog"
+	"net/http"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
@@ -11,16 +12,65 @@ import (
 	"github.com/cenkalti/backoff/v5"
 )
 
+const (
+	DefaultPDSHost = "https://bsky.social"
+	AppViewHost    = "https://public.api.bsky.app"
+)
+
+type HostResolver interface {
+	PDS(ctx context.Context, did string) (string, error)
+}
+
+type StaticHost string
+
+func (s StaticHost) PDS(ctx context.Context, did string) (string, error) {
+	return string(s), nil
+}
+
+var defaultClient = defaultHTTPClient()
+
+func defaultHTTPClient() *http.Client {
+	client, err := NewHTTPClient(HTTPOptions{RateLimit: DefaultRateLimit})
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
 type APIClient interface {
-	SyncGetBlob(ctx context.Context, client *xrpc.Client, cid, repo string) ([]byte, error)
+	PDSClient(ctx context.Context, repo string) (*xrpc.Client, error)
+	AppViewClient() *xrpc.Client
+	SyncGetBlobStream(ctx context.Context, client *xrpc.Client, cid, repo string, offset int64) (*BlobStream, error)
 	RepoGetRecord(ctx context.Context, client *xrpc.Client, cid, collection, repo, rkey string) (*atproto.RepoGetRecord_Output, error)
 	FeedGetPosts(ctx context.Context, client *xrpc.Client, uris []string) (*bsky.FeedGetPosts_Output, error)
 }
 
-type DefaultAPIClient struct{}
+type DefaultAPIClient struct {
+	Hosts      HostResolver
+	HTTPClient *http.Client
+}
 
-func (d *DefaultAPIClient) SyncGetBlob(ctx context.Context, client *xrpc.Client, cid, repo string) ([]byte, error) {
-	return atproto.SyncGetBlob(ctx, client, cid, repo)
+func (d *DefaultAPIClient) PDSClient(ctx context.Context, repo string) (*xrpc.Client, error) {
+	var hosts HostResolver = StaticHost(DefaultPDSHost)
+	if d.Hosts != nil {
+		hosts = d.Hosts
+	}
+	host, err := hosts.PDS(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return &xrpc.Client{Client: d.httpClient(), Host: host}, nil
+}
+
+func (d *DefaultAPIClient) AppViewClient() *xrpc.Client {
+	return &xrpc.Client{Client: d.httpClient(), Host: AppViewHost}
+}
+
+func (d *DefaultAPIClient) httpClient() *http.Client {
+	if d.HTTPClient != nil {
+		return d.HTTPClient
+	}
+	return defaultClient
 }
 
 func (d *DefaultAPIClient) RepoGetRecord(ctx context.Context, client *xrpc.Client, cid, collection, repo, rkey string) (*atproto.RepoGetRecord_Output, error) {
@@ -32,67 +82,32 @@ func (d *DefaultAPIClient) FeedGetPosts(ctx context.Context, client *xrpc.Client
 }
 
 var (
-	BackoffOpts = backoff.WithBackOff(
-		&backoff.ExponentialBackOff{
+	NewBackOff = func() backoff.BackOff {
+		return &backoff.ExponentialBackOff{
 			InitialInterval:     1 * time.Second,
 			RandomizationFactor: 0.5,
 			Multiplier:          2,
 			MaxInterval:         32 * time.Second,
-		})
+		}
+	}
 	MaxRetries = backoff.WithMaxTries(5)
 	Notify     = backoff.WithNotify(func(err error, time time.Duration) {
 		slog.Error("error occurred when making API request, attempting to retry", "retry-after", time.Seconds(), "error", err.Error())
 	})
 )
 
-func GetBlob(client APIClient, repo, cid string) (*[]byte, error) {
-	operation := func() (*[]byte, error) {
-		ctx := context.Background()
-		res, err := client.SyncGetBlob(ctx, &xrpc.Client{
-			Host: "https://bsky.social",
-		}, cid, repo)
-		if err != nil {
-			return nil, err
-		}
-		return &res, nil
-	}
-	res, err := backoff.Retry(context.TODO(), operation, BackoffOpts, MaxRetries, Notify)
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
-}
-
 func GetRecord(ctx context.Context, client APIClient, collection, repo, rkey string) (*atproto.RepoGetRecord_Output, error) {
-	operation := func() (*atproto.RepoGetRecord_Output, error) {
-		res, err := client.RepoGetRecord(ctx, &xrpc.Client{
-			Host: "https://bsky.social",
-		}, "", collection, repo, rkey)
+	return retry(ctx, func(ctx context.Context) (*atproto.RepoGetRecord_Output, error) {
+		xrpcClient, err := client.PDSClient(ctx, repo)
 		if err != nil {
 			return nil, err
 		}
-		return res, nil
-	}
-	res, err := backoff.Retry(ctx, operation, BackoffOpts, MaxRetries, Notify)
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
+		return client.RepoGetRecord(ctx, xrpcClient, "", collection, repo, rkey)
+	})
 }
 
 func GetPost(ctx context.Context, client APIClient, atUri string) (*bsky.FeedGetPosts_Output, error) {
-	operation := func() (*bsky.FeedGetPosts_Output, error) {
-		res, err := client.FeedGetPosts(ctx, &xrpc.Client{
-			Host: "https://public.api.bsky.app",
-		}, []string{atUri})
-		if err != nil {
-			return nil, err
-		}
-		return res, nil
-	}
-	res, err := backoff.Retry(ctx, operation, BackoffOpts, MaxRetries, Notify)
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
+	return retry(ctx, func(ctx context.Context) (*bsky.FeedGetPosts_Output, error) {
+		return client.FeedGetPosts(ctx, client.AppViewClient(), []string{atUri})
+	})
 }
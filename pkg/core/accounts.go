@@ -0,0 +1,130 @@
+package core
+
+import (
+	"firehose/pkg/utils"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type AccountStats struct {
+	Seen     atomic.Int64
+	Archived atomic.Int64
+	Failed   atomic.Int64
+	Deleted  atomic.Int64
+}
+
+type Account struct {
+	Did       string
+	Handle    string
+	Directory string
+	Root      string
+	Stats     AccountStats
+	mu        sync.RWMutex
+	inactive  bool
+	status    string
+}
+
+func (a *Account) CurrentHandle() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.Handle
+}
+
+func (a *Account) CurrentDirectory() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.Directory
+}
+
+func (a *Account) SetHandle(handle string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous := a.Handle
+	a.Handle = handle
+	if a.Root != "" {
+		a.Directory = AccountDirectory(a.Root, accountName(a.Did, handle))
+	}
+	return previous
+}
+
+func accountName(did, handle string) string {
+	if handle == "" || handle == utils.InvalidHandle {
+		return did
+	}
+	return handle
+}
+
+func AccountDirectory(root, handle string) string {
+	return filepath.Join(root, strings.ReplaceAll(handle, ":", "_"))
+}
+
+func (a *Account) Active() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return !a.inactive
+}
+
+func (a *Account) Status() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.status
+}
+
+func (a *Account) SetStatus(active bool, status string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inactive = !active
+	a.status = status
+}
+
+type Accounts struct {
+	byDid map[string]*Account
+}
+
+func NewAccounts(accounts ...*Account) *Accounts {
+	a := &Accounts{byDid: make(map[string]*Account, len(accounts))}
+	for _, account := range accounts {
+		a.byDid[account.Did] = account
+	}
+	return a
+}
+
+func (a *Accounts) Lookup(did string) (*Account, bool) {
+	account, ok := a.byDid[did]
+	return account, ok
+}
+
+func (a *Accounts) Dids() []string {
+	dids := make([]string, 0, len(a.byDid))
+	for did := range a.byDid {
+		dids = append(dids, did)
+	}
+	sort.Strings(dids)
+	return dids
+}
+
+func (a *Accounts) All() []*Account {
+	accounts := make([]*Account, 0, len(a.byDid))
+	for _, did := range a.Dids() {
+		accounts = append(accounts, a.byDid[did])
+	}
+	return accounts
+}
+
+func (a *Accounts) LogStats() {
+	for _, account := range a.All() {
+		slog.Info("account stats",
+			"did", account.Did,
+			"handle", account.CurrentHandle(),
+			"active", account.Active(),
+			"seen", account.Stats.Seen.Load(),
+			"archived", account.Stats.Archived.Load(),
+			"failed", account.Stats.Failed.Load(),
+			"deleted", account.Stats.Deleted.Load(),
+		)
+	}
+}
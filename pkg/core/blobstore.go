@@ -0,0 +1,274 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"firehose/pkg/api"
+	"firehose/pkg/utils"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	BlobsDirectory    = "blobs"
+	BlobIndexFilename = "fw.blobs.jsonl"
+	LinkHard          = "hard"
+	LinkSymbolic      = "symbolic"
+)
+
+var LinkModes = []string{LinkHard, LinkSymbolic}
+
+type BlobRef struct {
+	Cid     string `json:"cid"`
+	Path    string `json:"path"`
+	Repo    string `json:"repo,omitempty"`
+	Rkey    string `json:"rkey,omitempty"`
+	Blob    string `json:"blob,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+type BlobStore struct {
+	fs    utils.FileSystem
+	root  string
+	link  string
+	mu    sync.Mutex
+	refs  map[string][]BlobRef
+	locks utils.KeyedMutex
+}
+
+func OpenBlobStore(FSClient utils.FileSystem, directory, link string) (*BlobStore, error) {
+	if link != LinkHard && link != LinkSymbolic {
+		return nil, fmt.Errorf("unknown link mode: %s", link)
+	}
+	root := filepath.Join(directory, BlobsDirectory)
+	if err := FSClient.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	store := &BlobStore{fs: FSClient, root: root, link: link, refs: map[string][]BlobRef{}}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *BlobStore) Path(cid, mediaType string) string {
+	return filepath.Join(s.root, cid+"."+mediaType)
+}
+
+func (s *BlobStore) References(cid string) []BlobRef {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]BlobRef(nil), s.refs[cid]...)
+}
+
+func (s *BlobStore) DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, layout *utils.PathTemplate, media *utils.Media, postDetails *PostDetails, directory string) ([]string, error) {
+	var paths []string
+	for _, blob := range blobFiles(layout, media, postDetails, directory) {
+		if err := ctx.Err(); err != nil {
+			return paths, err
+		}
+		if err := utils.MakeParents(FSClient, directory, blob.Path); err != nil {
+			return paths, err
+		}
+		path, err := s.store(ctx, APIClient, FSClient, postDetails, blob)
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func (s *BlobStore) Release(path string) error {
+	var errs []error
+	for _, cid := range s.cidsFor(path) {
+		if err := s.release(cid, path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *BlobStore) store(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, postDetails *PostDetails, blob blobFile) (string, error) {
+	unlock := s.locks.Lock(blob.Cid)
+	defer unlock()
+	stored := s.Path(blob.Cid, blob.Ext)
+	if err := s.fetch(ctx, APIClient, FSClient, postDetails.Repo, blob.Cid, stored); err != nil {
+		return "", err
+	}
+	path, err := s.linkBlob(FSClient, stored, blob.Path)
+	if err != nil {
+		return "", fmt.Errorf("error linking blob: %w The path: %s", err, blob.Path)
+	}
+	if err := s.addRef(BlobRef{Cid: blob.Cid, Path: path, Repo: postDetails.Repo, Rkey: postDetails.Rkey, Blob: filepath.Base(stored)}); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (s *BlobStore) fetch(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, repo, cid, stored string) error {
+	if _, err := FSClient.Stat(stored); err == nil {
+		slog.Info("blob already stored, skipping download", "cid", cid, "path", stored)
+		return nil
+	}
+	return api.DownloadBlob(ctx, APIClient, FSClient, repo, cid, stored)
+}
+
+func (s *BlobStore) linkBlob(FSClient utils.FileSystem, stored, path string) (string, error) {
+	if linked, err := FSClient.Stat(path); err == nil {
+		if blob, err := FSClient.Stat(stored); err == nil && os.SameFile(linked, blob) {
+			return path, nil
+		}
+	}
+	target, err := utils.ResolveConflict(FSClient, path)
+	if err != nil {
+		return "", err
+	}
+	if target == "" {
+		return path, nil
+	}
+	tmp := utils.TempPath(target)
+	if s.link == LinkSymbolic {
+		relative, err := filepath.Rel(filepath.Dir(target), stored)
+		if err != nil {
+			return "", err
+		}
+		if err := FSClient.Symlink(relative, tmp); err != nil {
+			return "", err
+		}
+	} else if err := FSClient.Link(stored, tmp); err != nil {
+		return "", err
+	}
+	if err := FSClient.Rename(tmp, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+func (s *BlobStore) addRef(ref BlobRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.refs[ref.Cid] {
+		if existing.Path == ref.Path {
+			return nil
+		}
+	}
+	if err := s.append(ref); err != nil {
+		return err
+	}
+	s.refs[ref.Cid] = append(s.refs[ref.Cid], ref)
+	return nil
+}
+
+func (s *BlobStore) cidsFor(path string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cids []string
+	for cid, refs := range s.refs {
+		for _, ref := range refs {
+			if ref.Path == path {
+				cids = append(cids, cid)
+				break
+			}
+		}
+	}
+	return cids
+}
+
+func (s *BlobStore) release(cid, path string) error {
+	unlock := s.locks.Lock(cid)
+	defer unlock()
+	released, unreferenced, err := s.dropRef(cid, path)
+	if err != nil || !unreferenced {
+		return err
+	}
+	stored := s.storedPath(released)
+	if err := s.fs.Remove(stored); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	slog.Info("blob is no longer referenced, removed it from the blob store", "cid", cid, "path", stored)
+	return nil
+}
+
+func (s *BlobStore) dropRef(cid, path string) (BlobRef, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs := s.refs[cid]
+	n := slices.IndexFunc(refs, func(ref BlobRef) bool { return ref.Path == path })
+	if n < 0 {
+		return BlobRef{}, false, nil
+	}
+	released := refs[n]
+	if err := s.append(BlobRef{Cid: cid, Path: path, Removed: true}); err != nil {
+		return released, false, err
+	}
+	remaining := slices.Delete(slices.Clone(refs), n, n+1)
+	if len(remaining) > 0 {
+		s.refs[cid] = remaining
+		return released, false, nil
+	}
+	delete(s.refs, cid)
+	return released, true, nil
+}
+
+func (s *BlobStore) storedPath(ref BlobRef) string {
+	if ref.Blob != "" {
+		return filepath.Join(s.root, ref.Blob)
+	}
+	return s.Path(ref.Cid, strings.TrimPrefix(filepath.Ext(ref.Path), "."))
+}
+
+func (s *BlobStore) append(ref BlobRef) error {
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(filepath.Join(s.root, BlobIndexFilename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (s *BlobStore) load() error {
+	path := filepath.Join(s.root, BlobIndexFilename)
+	f, err := s.fs.OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var ref BlobRef
+		if err := json.Unmarshal(line, &ref); err != nil {
+			return fmt.Errorf("error reading blob index: %w The path: %s", err, path)
+		}
+		if ref.Removed {
+			s.refs[ref.Cid] = slices.DeleteFunc(s.refs[ref.Cid], func(existing BlobRef) bool { return existing.Path == ref.Path })
+			if len(s.refs[ref.Cid]) == 0 {
+				delete(s.refs, ref.Cid)
+			}
+			continue
+		}
+		s.refs[ref.Cid] = append(s.refs[ref.Cid], ref)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"firehose/pkg/api"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+)
+
+type RepoPath struct {
+	Collection syntax.NSID
+	Rkey       syntax.RecordKey
+}
+
+func ParseRepoPath(path string) (*RepoPath, error) {
+	collection, rkey, err := syntax.ParseRepoPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repo path: %s: %w", path, err)
+	}
+	return &RepoPath{Collection: collection, Rkey: rkey}, nil
+}
+
+func (rp *RepoPath) String() string {
+	return fmt.Sprintf("%s/%s", rp.Collection, rp.Rkey)
+}
+
+type CollectionHandler func(ctx context.Context, client api.APIClient, repo, rkey string, record lexutil.CBOR) (string, lexutil.CBOR, error)
+
+type CollectionRegistry struct {
+	handlers map[syntax.NSID]CollectionHandler
+}
+
+var CollectionNames = map[string]syntax.NSID{
+	"like":   LikeCollection,
+	"repost": RepostCollection,
+	"post":   PostCollection,
+}
+
+var SupportedCollections = NewCollectionRegistry().
+	Register(LikeCollection, FetchLikeSubject).
+	Register(RepostCollection, FetchRepostSubject).
+	Register(PostCollection, func(ctx context.Context, client api.APIClient, repo, rkey string, record lexutil.CBOR) (string, lexutil.CBOR, error) {
+		return MakePostIdentifier(repo, rkey), record, nil
+	})
+
+func NewCollectionRegistry() *CollectionRegistry {
+	return &CollectionRegistry{handlers: map[syntax.NSID]CollectionHandler{}}
+}
+
+func (cr *CollectionRegistry) Register(collection syntax.NSID, handler CollectionHandler) *CollectionRegistry {
+	cr.handlers[collection] = handler
+	return cr
+}
+
+func (cr *CollectionRegistry) Lookup(collection syntax.NSID) (CollectionHandler, bool) {
+	handler, ok := cr.handlers[collection]
+	return handler, ok
+}
+
+func (cr *CollectionRegistry) Collections() []syntax.NSID {
+	collections := make([]syntax.NSID, 0, len(cr.handlers))
+	for collection := range cr.handlers {
+		collections = append(collections, collection)
+	}
+	sort.Slice(collections, func(i, j int) bool { return collections[i] < collections[j] })
+	return collections
+}
+
+func SelectCollections(names []string) (*CollectionRegistry, error) {
+	registry := NewCollectionRegistry()
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		collection, ok := CollectionNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collection: %s", name)
+		}
+		handler, _ := SupportedCollections.Lookup(collection)
+		registry.Register(collection, handler)
+	}
+	if len(registry.handlers) == 0 {
+		return nil, fmt.Errorf("no collections selected")
+	}
+	return registry, nil
+}
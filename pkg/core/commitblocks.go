@@ -0,0 +1,41 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+type CommitBlocks struct {
+	bs blockstore.Blockstore
+}
+
+func ReadCommitBlocks(ctx context.Context, blocks []byte) (*CommitBlocks, error) {
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	if _, err := repo.IngestRepo(ctx, bs, bytes.NewReader(blocks)); err != nil {
+		return nil, fmt.Errorf("error reading commit blocks: %w", err)
+	}
+	return &CommitBlocks{bs: bs}, nil
+}
+
+func (cb *CommitBlocks) Record(ctx context.Context, c cid.Cid) (lexutil.CBOR, error) {
+	blk, err := cb.bs.Get(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("record block missing from commit: %w The CID: %s", err, c)
+	}
+	return lexutil.CborDecodeValue(blk.RawData())
+}
+
+func (cb *CommitBlocks) OpRecord(ctx context.Context, op *atproto.SyncSubscribeRepos_RepoOp) (lexutil.CBOR, error) {
+	if op.Cid == nil {
+		return nil, fmt.Errorf("operation has no CID: %s", op.Path)
+	}
+	return cb.Record(ctx, cid.Cid(*op.Cid))
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"firehose/pkg/utils"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+)
+
+const (
+	CursorFilename = "fw.cursor"
+	OutdatedCursor = "OutdatedCursor"
+)
+
+type Cursor struct {
+	mu    sync.Mutex
+	path  string
+	host  string
+	seq   int64
+	dirty bool
+}
+
+type cursorState struct {
+	Host string `json:"host,omitempty"`
+	Seq  int64  `json:"seq"`
+}
+
+func LoadCursor(path string) (*Cursor, error) {
+	cursor := &Cursor{path: path, seq: -1}
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cursor, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state cursorState
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return nil, fmt.Errorf("error reading cursor state file: %w The path: %s", err, path)
+	}
+	cursor.host = state.Host
+	cursor.seq = state.Seq
+	return cursor, nil
+}
+
+func (c *Cursor) Seq() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+func (c *Cursor) Host() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.host
+}
+
+func (c *Cursor) SeqFor(host string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.host != "" && c.host != host {
+		return -1
+	}
+	return c.seq
+}
+
+func (c *Cursor) SwitchHost(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.host == host {
+		return
+	}
+	if c.host != "" {
+		slog.Warn("firehose host changed, sequence numbers are not portable between hosts", "event", "cursor_gap", "from", c.host, "to", host, "cursor", c.seq)
+		c.seq = -1
+	}
+	c.host = host
+	c.dirty = true
+}
+
+func (c *Cursor) Set(seq int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq <= c.seq {
+		return
+	}
+	c.seq = seq
+	c.dirty = true
+}
+
+func (c *Cursor) Reset(seq int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.host = ""
+	c.seq = seq
+	c.dirty = true
+}
+
+func (c *Cursor) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+
+	bytes, err := json.Marshal(cursorState{Host: c.host, Seq: c.seq})
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(&utils.DefaultFileSystem{}, c.path, bytes); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *Cursor) FlushEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := c.Flush(); err != nil {
+				slog.Error("error flushing cursor", "path", c.path, "error", err)
+			}
+		}
+	}
+}
+
+func TrackCursor(cursor *Cursor, next func(ctx context.Context, xev *events.XRPCStreamEvent) error) func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+	return func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+		if xev.RepoInfo != nil && xev.RepoInfo.Name == OutdatedCursor {
+			message := ""
+			if xev.RepoInfo.Message != nil {
+				message = *xev.RepoInfo.Message
+			}
+			slog.Warn("firehose cursor is outdated, events have been missed", "event", "cursor_gap", "cursor", cursor.Seq(), "message", message)
+		}
+
+		if err := next(ctx, xev); err != nil {
+			return err
+		}
+
+		if seq := xev.Sequence(); seq >= 0 {
+			cursor.Set(seq)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"firehose/pkg/api"
+	"firehose/pkg/utils"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DeadLetterFilename = "fw.deadletter.jsonl"
+	FailureDeleted     = "deleted"
+	FailureAuth        = "auth"
+	FailureRejected    = "rejected"
+	FailureRateLimited = "rate-limited"
+	FailureTransient   = "transient"
+)
+
+var FailureClasses = []string{FailureDeleted, FailureAuth, FailureRejected, FailureRateLimited, FailureTransient}
+
+var ErrSubjectDeleted = errors.New("subject was deleted")
+
+type DownloadError struct {
+	AtUri string
+	Class string
+	Err   error
+}
+
+func (e *DownloadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+type DeadLetter struct {
+	AtUri       string    `json:"atUri,omitempty"`
+	Repo        string    `json:"repo"`
+	Path        string    `json:"path"`
+	Seq         int64     `json:"seq,omitempty"`
+	Rev         string    `json:"rev,omitempty"`
+	Handle      string    `json:"handle,omitempty"`
+	Directory   string    `json:"directory"`
+	Class       string    `json:"class"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	FirstFailed time.Time `json:"firstFailed"`
+	LastFailed  time.Time `json:"lastFailed"`
+}
+
+type DeadLetterFilter struct {
+	Classes   []string
+	OlderThan time.Duration
+	NewerThan time.Duration
+}
+
+type DeadLetterStore struct {
+	fs   utils.FileSystem
+	path string
+	mu   sync.Mutex
+}
+
+func ClassifyFailure(err error) string {
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) && downloadErr.Class != "" {
+		return downloadErr.Class
+	}
+	if errors.Is(err, ErrSubjectDeleted) {
+		return FailureDeleted
+	}
+	switch api.ClassOf(err) {
+	case api.ErrorNotFound:
+		return FailureDeleted
+	case api.ErrorAuth:
+		return FailureAuth
+	case api.ErrorRejected:
+		return FailureRejected
+	case api.ErrorRateLimited:
+		return FailureRateLimited
+	}
+	return FailureTransient
+}
+
+func NewDeadLetter(op *RepoOp, directory string, err error, now time.Time) *DeadLetter {
+	letter := &DeadLetter{
+		Repo:        op.Repo,
+		Path:        op.Path,
+		Seq:         op.Seq,
+		Rev:         op.Rev,
+		Handle:      op.Handle,
+		Directory:   directory,
+		Class:       ClassifyFailure(err),
+		Error:       err.Error(),
+		Attempts:    failedAttempts(err),
+		FirstFailed: now,
+		LastFailed:  now,
+	}
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) {
+		letter.AtUri = downloadErr.AtUri
+	}
+	return letter
+}
+
+func (l *DeadLetter) RepoOp() *RepoOp {
+	return &RepoOp{Seq: l.Seq, Repo: l.Repo, Rev: l.Rev, Action: "create", Path: l.Path, Handle: l.Handle}
+}
+
+func (l *DeadLetter) Failed(err error, now time.Time) {
+	l.Class = ClassifyFailure(err)
+	l.Error = err.Error()
+	l.Attempts += failedAttempts(err)
+	l.LastFailed = now
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) && downloadErr.AtUri != "" {
+		l.AtUri = downloadErr.AtUri
+	}
+}
+
+func failedAttempts(err error) int {
+	return max(api.AttemptsOf(err), 1)
+}
+
+func (f *DeadLetterFilter) Matches(letter *DeadLetter, now time.Time) bool {
+	if len(f.Classes) > 0 && !slices.Contains(f.Classes, letter.Class) {
+		return false
+	}
+	age := now.Sub(letter.LastFailed)
+	if f.OlderThan > 0 && age < f.OlderThan {
+		return false
+	}
+	if f.NewerThan > 0 && age > f.NewerThan {
+		return false
+	}
+	return true
+}
+
+func NewDeadLetterStore(FSClient utils.FileSystem, path string) *DeadLetterStore {
+	return &DeadLetterStore{fs: FSClient, path: path}
+}
+
+func (s *DeadLetterStore) Add(letter *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (s *DeadLetterStore) Load() ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.fs.OpenFile(s.path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []*DeadLetter
+	index := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(line, &letter); err != nil {
+			return nil, fmt.Errorf("error reading dead letters: %w The path: %s", err, s.path)
+		}
+		key := letter.Repo + "/" + letter.Path
+		if i, ok := index[key]; ok {
+			previous := letters[i]
+			letter.Attempts += previous.Attempts
+			letter.FirstFailed = previous.FirstFailed
+			letters[i] = &letter
+			continue
+		}
+		index[key] = len(letters)
+		letters = append(letters, &letter)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+func (s *DeadLetterStore) Replace(letters []*DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(letters) == 0 {
+		if err := s.fs.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, letter := range letters {
+		if err := encoder.Encode(letter); err != nil {
+			return err
+		}
+	}
+	return utils.WriteFileAtomic(s.fs, s.path, buf.Bytes())
+}
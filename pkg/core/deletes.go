@@ -0,0 +1,79 @@
+package core
+
+import (
+	"log/slog"
+	"time"
+)
+
+func (a *Archiver) WithRecordIndex(index *RecordIndex, deletePolicy string) *Archiver {
+	a.index = index
+	a.deletePolicy = deletePolicy
+	return a
+}
+
+func (a *Archiver) RecordDelete(op *RepoOp, account *Account) {
+	if a.Paused(account) {
+		slog.Info("account is inactive, skipping operation", "action", op.Action, "path", op.Path, "did", op.Repo, "status", account.Status())
+		return
+	}
+	if a.deferDelete(op) {
+		slog.Info("record deleted while its create is queued, deferring delete", "path", op.Path, "did", op.Repo)
+		return
+	}
+	a.applyDelete(op, account)
+}
+
+func (a *Archiver) applyDelete(op *RepoOp, account *Account) {
+	tombstone, err := a.index.Delete(op, a.deletePolicy, time.Now().UTC())
+	if err != nil {
+		slog.Error("Error applying delete", "error", err, "path", op.Path, "did", op.Repo, "policy", a.deletePolicy)
+	}
+	if tombstone == nil {
+		return
+	}
+	account.Stats.Deleted.Add(1)
+	if tombstone.AtUri == "" {
+		slog.Info("record deleted before it was archived, recorded tombstone", "path", op.Path, "did", op.Repo)
+		return
+	}
+	slog.Info("record deleted, recorded tombstone", "path", op.Path, "did", op.Repo, "aturi", tombstone.AtUri, "policy", a.deletePolicy, "files", len(tombstone.Files), "shared", len(tombstone.Shared))
+}
+
+func (a *Archiver) deferDelete(op *RepoOp) bool {
+	a.deletesMu.Lock()
+	defer a.deletesMu.Unlock()
+	if !a.queue.Outstanding(op.Repo, op.Path) {
+		return false
+	}
+	a.pendingDeletes[indexKey(op.Repo, op.Path)] = op
+	return true
+}
+
+func (a *Archiver) deletePending(op *RepoOp) bool {
+	a.deletesMu.Lock()
+	defer a.deletesMu.Unlock()
+	_, ok := a.pendingDeletes[indexKey(op.Repo, op.Path)]
+	return ok
+}
+
+func (a *Archiver) finish(job *Job, account *Account) {
+	a.deletesMu.Lock()
+	defer a.deletesMu.Unlock()
+	key := indexKey(job.Op.Repo, job.Op.Path)
+	if deleted, ok := a.pendingDeletes[key]; ok {
+		delete(a.pendingDeletes, key)
+		if account != nil {
+			a.applyDelete(deleted, account)
+		}
+	}
+	a.queue.Done(job)
+}
+
+func (a *Archiver) indexArchived(op *RepoOp, archived *ArchivedPost) {
+	if a.index == nil || archived == nil {
+		return
+	}
+	if err := a.index.Add(NewIndexEntry(op.Repo, op.Path, archived, time.Now().UTC())); err != nil {
+		slog.Error("Error indexing archived record", "error", err, "path", op.Path, "did", op.Repo)
+	}
+}
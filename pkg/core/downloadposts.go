@@ -9,122 +9,181 @@ import (
 	"time"
 
 	"github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
 )
 
 type PostDetails struct {
-	Handle   string
-	Text     string
-	Repo     string
-	Response *bsky.FeedPost
-	Rkey     string
-	Media    *utils.Media
+	Handle          string
+	Text            string
+	Repo            string
+	Cid             string
+	Response        *bsky.FeedPost
+	Rkey            string
+	Media           *utils.Media
+	Source          *RepoOp
+	SourceCreatedAt string
+	ArchivedAt      time.Time
 }
 
 type DownloadClient interface {
-	FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string) (string, error)
-	FetchPostDetails(ctx context.Context, client api.APIClient, atUri string) (*PostDetails, error)
-	DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, media *utils.Media, postDetails *PostDetails, directory string) error
+	FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string, record lexutil.CBOR) (string, lexutil.CBOR, error)
+	FetchPostDetails(ctx context.Context, client api.APIClient, atUri string, source *RepoOp) (*PostDetails, error)
+	DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, media *utils.Media, postDetails *PostDetails, directory string) ([]string, error)
+	PathLayout() *utils.PathTemplate
+	AltTextSidecars() bool
 }
 
-type DefaultDownloadClient struct{}
+type DefaultDownloadClient struct {
+	Blobs       *BlobStore
+	Collections *CollectionRegistry
+	Layout      *utils.PathTemplate
+	AltText     bool
+}
+
+func (dc *DefaultDownloadClient) FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string, record lexutil.CBOR) (string, lexutil.CBOR, error) {
+	if dc.Collections != nil {
+		return dc.Collections.FetchPostIdentifier(ctx, client, repo, path, record)
+	}
+	return FetchPostIdentifier(ctx, client, repo, path, record)
+}
+
+func (dc *DefaultDownloadClient) FetchPostDetails(ctx context.Context, client api.APIClient, atUri string, source *RepoOp) (*PostDetails, error) {
+	return FetchPostDetails(ctx, client, atUri, source)
+}
+
+func (dc *DefaultDownloadClient) DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, media *utils.Media, postDetails *PostDetails, directory string) ([]string, error) {
+	if dc.Blobs != nil {
+		return dc.Blobs.DownloadBlobs(ctx, APIClient, FSClient, dc.PathLayout(), media, postDetails, directory)
+	}
+	return DownloadBlobs(ctx, APIClient, FSClient, dc.PathLayout(), media, postDetails, directory)
+}
 
-func (dc *DefaultDownloadClient) FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string) (string, error) {
-	return FetchPostIdentifier(ctx, client, repo, path)
+func (dc *DefaultDownloadClient) PathLayout() *utils.PathTemplate {
+	return pathLayout(dc.Layout)
 }
 
-func (dc *DefaultDownloadClient) FetchPostDetails(ctx context.Context, client api.APIClient, atUri string) (*PostDetails, error) {
-	return FetchPostDetails(ctx, client, atUri)
+func (dc *DefaultDownloadClient) AltTextSidecars() bool {
+	return dc.AltText
 }
 
-func (dc *DefaultDownloadClient) DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, media *utils.Media, postDetails *PostDetails, directory string) error {
-	return DownloadBlobs(ctx, APIClient, FSClient, media, postDetails, directory)
+type ArchivedPost struct {
+	AtUri string
+	Files []string
 }
 
-func DownloadPost(ctx context.Context, downloadClient DownloadClient, APIClient api.APIClient, FSClient utils.FileSystem, repo string, repo_path string, directory string) {
-	atUri, err := downloadClient.FetchPostIdentifier(ctx, APIClient, repo, repo_path)
+func ArchivePost(ctx context.Context, downloadClient DownloadClient, APIClient api.APIClient, FSClient utils.FileSystem, op *RepoOp, directory string) (*ArchivedPost, error) {
+	atUri, record, err := downloadClient.FetchPostIdentifier(ctx, APIClient, op.Repo, op.Path, op.Record)
 	if err != nil {
-		slog.Error(err.Error())
-		return
+		return nil, downloadFailed("", err)
 	}
 	slog.Info("retrieved post aturi", "aturi", atUri)
 
-	postDetails, err := downloadClient.FetchPostDetails(ctx, APIClient, atUri)
+	fetched, err := downloadClient.FetchPostDetails(ctx, APIClient, atUri, op)
 	if err != nil {
-		slog.Error(err.Error())
-		return
+		return nil, downloadFailed(atUri, err)
 	}
-	slog.Info("retrieved post details", "details", postDetails)
+	slog.Info("retrieved post details", "details", fetched)
+	postDetails := *fetched
+	postDetails.Source = op
+	postDetails.SourceCreatedAt = sourceCreatedAt(op, record, postDetails.Response)
+	postDetails.ArchivedAt = time.Now().UTC()
 
+	archived := &ArchivedPost{AtUri: atUri}
+	var blobs []string
 	if postDetails.Media != nil {
 		media := postDetails.Media
 
-		err = downloadClient.DownloadBlobs(ctx, APIClient, FSClient, media, postDetails, directory)
+		blobs, err = downloadClient.DownloadBlobs(ctx, APIClient, FSClient, media, &postDetails, directory)
 		if err != nil {
-			slog.Error(err.Error())
-			return
+			return nil, downloadFailed(atUri, err)
+		}
+		archived.Files = append(archived.Files, blobs...)
+		if downloadClient.AltTextSidecars() {
+			files, err := writeAltText(FSClient, downloadClient.PathLayout(), &postDetails, directory)
+			if err != nil {
+				return nil, downloadFailed(atUri, err)
+			}
+			archived.Files = append(archived.Files, files...)
 		}
 		slog.Info("downloaded blobs associated with post", "aturi", atUri)
 	}
 
-	filename := utils.MakeFilepath(directory, postDetails.Rkey, postDetails.Handle, postDetails.Text, "json", 0, 255)
+	if err := ctx.Err(); err != nil {
+		return nil, downloadFailed(atUri, err)
+	}
+	filename := metadataFilename(downloadClient.PathLayout(), &postDetails, directory)
 
-	bytes, err := json.MarshalIndent(postDetails.Response, "", "	")
+	envelope := NewEnvelope(op, atUri, &postDetails, postDetails.ArchivedAt)
+	envelope.Media = envelopeMedia(&postDetails, blobs, filename)
+	bytes, err := json.MarshalIndent(envelope, "", "	")
+	if err != nil {
+		return nil, downloadFailed(atUri, err)
+	}
+	err = utils.MakeParents(FSClient, directory, filename)
 	if err != nil {
-		slog.Error(err.Error())
-		return
+		return nil, downloadFailed(atUri, err)
 	}
-	err = utils.WriteFile(FSClient, filename, &bytes)
+	filename, err = utils.WriteFile(FSClient, filename, &bytes)
 	if err != nil {
-		slog.Error(err.Error())
-		return
+		return nil, downloadFailed(atUri, err)
 	}
+	archived.Files = append(archived.Files, filename)
 	slog.Info("wrote to file system post metadata and blob(s) associated with post", "aturi", atUri)
+	return archived, nil
 }
 
-func DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, media *utils.Media, postDetails *PostDetails, directory string) error {
-	if media.ImageCid != nil {
-		for i, imageCid := range media.ImageCid {
-			res, err := api.GetBlob(APIClient, postDetails.Repo, imageCid)
-			if err != nil {
-				return err
-			}
-			number := 0
-			if len(media.ImageCid) > 1 {
-				number = i + 1
-			}
-			filename := utils.MakeFilepath(
-				directory,
-				postDetails.Rkey,
-				postDetails.Handle,
-				postDetails.Text,
-				postDetails.Media.MediaType,
-				number,
-				255,
-			)
-			if err := utils.WriteFile(FSClient, filename, res); err != nil {
-				return err
-			}
-			time.Sleep(500 * time.Millisecond)
-		}
+func downloadFailed(atUri string, err error) error {
+	downloadErr := &DownloadError{AtUri: atUri, Class: ClassifyFailure(err), Err: err}
+	if downloadErr.Class == FailureDeleted {
+		slog.Warn("subject no longer exists, not retrying", "aturi", atUri, "error", err.Error())
+	} else {
+		slog.Error(err.Error(), "aturi", atUri, "class", downloadErr.Class)
 	}
-	if media.VideoCid != "" {
-		res, err := api.GetBlob(APIClient, postDetails.Repo, media.VideoCid)
+	return downloadErr
+}
+
+func DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, layout *utils.PathTemplate, media *utils.Media, postDetails *PostDetails, directory string) ([]string, error) {
+	var paths []string
+	for _, blob := range blobFiles(layout, media, postDetails, directory) {
+		if err := ctx.Err(); err != nil {
+			return paths, err
+		}
+		if err := utils.MakeParents(FSClient, directory, blob.Path); err != nil {
+			return paths, err
+		}
+		target, err := utils.ResolveConflict(FSClient, blob.Path)
 		if err != nil {
-			return err
+			return paths, err
 		}
-		filename := utils.MakeFilepath(
-			directory,
-			postDetails.Rkey,
-			postDetails.Handle,
-			postDetails.Text,
-			postDetails.Media.MediaType,
-			0,
-			255,
-		)
-		if err := utils.WriteFile(FSClient, filename, res); err != nil {
-			return err
+		if target == "" {
+			slog.Info("blob already exists, skipping", "path", blob.Path)
+			paths = append(paths, blob.Path)
+			continue
+		}
+		if err := api.DownloadBlob(ctx, APIClient, FSClient, postDetails.Repo, blob.Cid, target); err != nil {
+			return paths, err
+		}
+		paths = append(paths, target)
+	}
+	return paths, nil
+}
+
+func writeAltText(FSClient utils.FileSystem, layout *utils.PathTemplate, postDetails *PostDetails, directory string) ([]string, error) {
+	var files []string
+	for _, item := range postDetails.Media.Items {
+		if item.Alt == "" {
+			continue
+		}
+		path := altTextFilename(layout, postDetails, directory, item)
+		if err := utils.MakeParents(FSClient, directory, path); err != nil {
+			return files, err
+		}
+		data := []byte(item.Alt + "\n")
+		written, err := utils.WriteFile(FSClient, path, &data)
+		if err != nil {
+			return files, err
 		}
-		time.Sleep(500 * time.Millisecond)
+		files = append(files, written)
 	}
-	return nil
+	return files, nil
 }
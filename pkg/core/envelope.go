@@ -0,0 +1,158 @@
+package core
+
+import (
+	"encoding/json"
+	"firehose/pkg/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+)
+
+const (
+	EnvelopeVersion = 1
+)
+
+type Envelope struct {
+	Version    int             `json:"version"`
+	Reason     string          `json:"reason,omitempty"`
+	Uri        string          `json:"uri,omitempty"`
+	Cid        string          `json:"cid,omitempty"`
+	Author     EnvelopeAuthor  `json:"author"`
+	Source     EnvelopeSource  `json:"source"`
+	ArchivedAt *time.Time      `json:"archivedAt,omitempty"`
+	Media      []EnvelopeMedia `json:"media,omitempty"`
+	Post       *bsky.FeedPost  `json:"post"`
+}
+
+type EnvelopeAuthor struct {
+	Did    string `json:"did,omitempty"`
+	Handle string `json:"handle,omitempty"`
+}
+
+type EnvelopeMedia struct {
+	utils.MediaItem
+	Path string `json:"path,omitempty"`
+}
+
+type EnvelopeSource struct {
+	Repo       string `json:"repo,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Rkey       string `json:"rkey,omitempty"`
+	CreatedAt  string `json:"createdAt,omitempty"`
+	Seq        int64  `json:"seq,omitempty"`
+	Rev        string `json:"rev,omitempty"`
+}
+
+func NewEnvelope(op *RepoOp, atUri string, postDetails *PostDetails, now time.Time) *Envelope {
+	envelope := &Envelope{
+		Version: EnvelopeVersion,
+		Uri:     atUri,
+		Cid:     postDetails.Cid,
+		Author: EnvelopeAuthor{
+			Did:    postDetails.Repo,
+			Handle: postDetails.Handle,
+		},
+		Source: EnvelopeSource{
+			Repo:      op.Repo,
+			CreatedAt: postDetails.SourceCreatedAt,
+			Seq:       op.Seq,
+			Rev:       op.Rev,
+		},
+		ArchivedAt: &now,
+		Post:       postDetails.Response,
+	}
+	if repoPath, err := ParseRepoPath(op.Path); err == nil {
+		envelope.Reason = collectionName(repoPath.Collection.String())
+		envelope.Source.Collection = repoPath.Collection.String()
+		envelope.Source.Rkey = repoPath.Rkey.String()
+	}
+	return envelope
+}
+
+func envelopeMedia(postDetails *PostDetails, paths []string, metadataPath string) []EnvelopeMedia {
+	if postDetails.Media == nil {
+		return nil
+	}
+	var media []EnvelopeMedia
+	for i, item := range postDetails.Media.Items {
+		entry := EnvelopeMedia{MediaItem: item}
+		if i < len(paths) {
+			if relative, err := filepath.Rel(filepath.Dir(metadataPath), paths[i]); err == nil {
+				entry.Path = filepath.ToSlash(relative)
+			}
+		}
+		media = append(media, entry)
+	}
+	return media
+}
+
+func LoadEnvelope(path string) (*Envelope, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := ReadEnvelope(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading post metadata: %w The path: %s", err, path)
+	}
+	return envelope, nil
+}
+
+func ReadEnvelope(data []byte) (*Envelope, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	switch probe.Version {
+	case 0:
+		var post bsky.FeedPost
+		if err := json.Unmarshal(data, &post); err != nil {
+			return nil, err
+		}
+		return &Envelope{Post: &post}, nil
+	case EnvelopeVersion:
+		var envelope Envelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+	}
+	return nil, fmt.Errorf("unsupported metadata version: %d", probe.Version)
+}
+
+func collectionName(collection string) string {
+	for name, nsid := range CollectionNames {
+		if nsid.String() == collection {
+			return name
+		}
+	}
+	return ""
+}
+
+func sourceCreatedAt(op *RepoOp, record lexutil.CBOR, post *bsky.FeedPost) string {
+	if createdAt := recordCreatedAt(record); createdAt != "" {
+		return createdAt
+	}
+	if repoPath, err := ParseRepoPath(op.Path); err == nil && repoPath.Collection == PostCollection && post != nil {
+		return post.CreatedAt
+	}
+	return ""
+}
+
+func recordCreatedAt(record lexutil.CBOR) string {
+	switch record := record.(type) {
+	case *bsky.FeedLike:
+		return record.CreatedAt
+	case *bsky.FeedRepost:
+		return record.CreatedAt
+	case *bsky.FeedPost:
+		return record.CreatedAt
+	}
+	return ""
+}
@@ -8,33 +8,88 @@ import (
 	"fmt"
 
 	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
 )
 
-func FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string) (string, error) {
-	rkey := utils.FindExpression("[^/]*$", path)
-	collection := utils.FindExpression("^[^/]*", path)
+const (
+	LikeCollection   syntax.NSID = "app.bsky.feed.like"
+	RepostCollection syntax.NSID = "app.bsky.feed.repost"
+	PostCollection   syntax.NSID = "app.bsky.feed.post"
+)
 
-	res, err := api.GetRecord(ctx, client, collection, repo, rkey)
+func FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string, record lexutil.CBOR) (string, lexutil.CBOR, error) {
+	return SupportedCollections.FetchPostIdentifier(ctx, client, repo, path, record)
+}
+
+func (cr *CollectionRegistry) FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string, record lexutil.CBOR) (string, lexutil.CBOR, error) {
+	repoPath, err := ParseRepoPath(path)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	bytes, err := res.Value.MarshalJSON()
-	if err != nil {
-		return "", err
+	handler, ok := cr.Lookup(repoPath.Collection)
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported collection: %s for path: %s", repoPath.Collection, path)
+	}
+	return handler(ctx, client, repo, repoPath.Rkey.String(), record)
+}
+
+func FetchLikeSubject(ctx context.Context, client api.APIClient, repo, rkey string, record lexutil.CBOR) (string, lexutil.CBOR, error) {
+	like, ok := record.(*bsky.FeedLike)
+	if !ok {
+		like = &bsky.FeedLike{}
+		if err := fetchRecord(ctx, client, LikeCollection.String(), repo, rkey, like); err != nil {
+			return "", nil, err
+		}
+	}
+	if like.Subject == nil {
+		return "", nil, fmt.Errorf("like has no subject: %s", rkey)
+	}
+
+	return like.Subject.Uri, like, nil
+}
+
+func FetchRepostSubject(ctx context.Context, client api.APIClient, repo, rkey string, record lexutil.CBOR) (string, lexutil.CBOR, error) {
+	repost, ok := record.(*bsky.FeedRepost)
+	if !ok {
+		repost = &bsky.FeedRepost{}
+		if err := fetchRecord(ctx, client, RepostCollection.String(), repo, rkey, repost); err != nil {
+			return "", nil, err
+		}
 	}
+	if repost.Subject == nil {
+		return "", nil, fmt.Errorf("repost has no subject: %s", rkey)
+	}
+
+	return repost.Subject.Uri, repost, nil
+}
+
+func MakePostIdentifier(repo, rkey string) string {
+	return fmt.Sprintf("at://%s/%s/%s", repo, PostCollection, rkey)
+}
 
-	var postDetails bsky.FeedLike
+func fetchRecord(ctx context.Context, client api.APIClient, collection, repo, rkey string, v any) error {
+	res, err := api.GetRecord(ctx, client, collection, repo, rkey)
+	if err != nil {
+		return err
+	}
 
-	err = json.Unmarshal(bytes, &postDetails)
+	bytes, err := res.Value.MarshalJSON()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return postDetails.Subject.Uri, nil
+	return json.Unmarshal(bytes, v)
 }
 
-func FetchPostDetails(ctx context.Context, client api.APIClient, atUri string) (*PostDetails, error) {
+func FetchPostDetails(ctx context.Context, client api.APIClient, atUri string, source *RepoOp) (*PostDetails, error) {
+	if source != nil {
+		if post, ok := source.Record.(*bsky.FeedPost); ok {
+			return localPostDetails(atUri, post, source)
+		}
+	}
+
 	res, err := api.GetPost(ctx, client, atUri)
 	if err != nil {
 		return nil, fmt.Errorf("error occurred, post is either missing or deleted: %w with the ATURI: %s", err, atUri)
@@ -44,7 +99,7 @@ func FetchPostDetails(ctx context.Context, client api.APIClient, atUri string) (
 	var record bsky.FeedPost
 
 	if len(res.Posts) < 1 {
-		return nil, fmt.Errorf("there is no post with this AT-URI: %s", atUri)
+		return nil, fmt.Errorf("there is no post with this AT-URI: %w The post ATURI: %s", ErrSubjectDeleted, atUri)
 	}
 
 	post := res.Posts[0]
@@ -66,6 +121,7 @@ func FetchPostDetails(ctx context.Context, client api.APIClient, atUri string) (
 	postDetails.Text = record.Text
 	postDetails.Response = &record
 	postDetails.Repo = post.Author.Did
+	postDetails.Cid = post.Cid
 
 	if record.Embed != nil {
 		postDetails.Media = utils.ExtractMedia(record.Embed)
@@ -73,3 +129,23 @@ func FetchPostDetails(ctx context.Context, client api.APIClient, atUri string) (
 
 	return &postDetails, nil
 }
+
+func localPostDetails(atUri string, post *bsky.FeedPost, source *RepoOp) (*PostDetails, error) {
+	uri, err := syntax.ParseATURI(atUri)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing post AT-URI: %w The post ATURI: %s", err, atUri)
+	}
+
+	postDetails := &PostDetails{
+		Handle:   accountName(uri.Authority().String(), source.Handle),
+		Text:     post.Text,
+		Repo:     uri.Authority().String(),
+		Cid:      source.Cid,
+		Response: post,
+		Rkey:     uri.RecordKey().String(),
+	}
+	if post.Embed != nil {
+		postDetails.Media = utils.ExtractMedia(post.Embed)
+	}
+	return postDetails, nil
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SubscribeReposPath = "/xrpc/com.atproto.sync.subscribeRepos"
+)
+
+type Firehose struct {
+	Hosts       []string
+	Cursor      *Cursor
+	Dialer      Dialer
+	Handler     func(ctx context.Context, xev *events.XRPCStreamEvent) error
+	IdleTimeout time.Duration
+	supervisor  *supervisor
+}
+
+func (fh *Firehose) Run(ctx context.Context) error {
+	return fh.state().run(ctx, fh.session)
+}
+
+func (fh *Firehose) Host() string {
+	return fh.state().host()
+}
+
+func (fh *Firehose) state() *supervisor {
+	if fh.supervisor == nil {
+		fh.supervisor = &supervisor{name: "firehose", hosts: fh.Hosts, cursor: fh.Cursor}
+	}
+	return fh.supervisor
+}
+
+func (fh *Firehose) uri(host string) string {
+	uri := host + SubscribeReposPath
+	if seq := fh.Cursor.SeqFor(host); seq >= 0 {
+		uri = fmt.Sprintf("%s?cursor=%d", uri, seq)
+	}
+	return uri
+}
+
+func (fh *Firehose) session(ctx context.Context, host string) error {
+	uri := fh.uri(host)
+	slog.Info("connecting to firehose", "uri", uri)
+	con, _, err := fh.Dialer.Dial(uri, http.Header{})
+	if err != nil {
+		return fmt.Errorf("websocket dial error: %w", err)
+	}
+	defer con.Close()
+	fh.Cursor.SwitchHost(host)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		con.Close()
+	}()
+
+	clock := newFrameClock()
+	keepAlive(ctx, con, host, fh.IdleTimeout, clock)
+
+	received := false
+	for {
+		mt, message, err := con.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !received {
+				return fmt.Errorf("%w: %w", errNoFrames, err)
+			}
+			slog.Warn("firehose connection dropped", "host", host, "cursor", fh.Cursor.Seq(), "error", err)
+			return nil
+		}
+		clock.touch()
+
+		if mt != websocket.BinaryMessage {
+			return errors.New("expected binary message from subscription endpoint")
+		}
+		var xev events.XRPCStreamEvent
+		if err := xev.Deserialize(bytes.NewReader(message)); err != nil {
+			return fmt.Errorf("error decoding firehose event: %w", err)
+		}
+		received = true
+
+		clock.pause()
+		err = fh.Handler(ctx, &xev)
+		clock.resume()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+)
+
+const (
+	TimelineFilename = "fw.timeline.jsonl"
+	IdentityTimeout  = 10 * time.Second
+)
+
+type IdentityResolver interface {
+	ResolveIdentity(ctx context.Context, did string) (string, error)
+}
+
+type TimelineEntry struct {
+	Kind           string `json:"kind"`
+	Did            string `json:"did"`
+	Seq            int64  `json:"seq"`
+	EventTime      string `json:"eventTime"`
+	RecordedAt     string `json:"recordedAt"`
+	Handle         string `json:"handle,omitempty"`
+	PreviousHandle string `json:"previousHandle,omitempty"`
+	Active         *bool  `json:"active,omitempty"`
+	Status         string `json:"status,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+func (a *Archiver) FollowIdentity(resolver IdentityResolver, pauseInactive bool) *Archiver {
+	a.identities = resolver
+	a.pauseInactive = pauseInactive
+	return a
+}
+
+func (a *Archiver) RepoIdentity(evt *atproto.SyncSubscribeRepos_Identity) error {
+	account, ok := a.accounts.Lookup(evt.Did)
+	if !ok {
+		return nil
+	}
+	entry := &TimelineEntry{
+		Kind:      "identity",
+		Did:       evt.Did,
+		Seq:       evt.Seq,
+		EventTime: evt.Time,
+	}
+
+	handle, err := a.resolveIdentity(evt)
+	if err != nil {
+		slog.Warn("error re-resolving handle, keeping the current one", "did", evt.Did, "handle", account.CurrentHandle(), "error", err)
+		entry.Handle = account.CurrentHandle()
+		entry.Error = err.Error()
+	} else {
+		directory := account.CurrentDirectory()
+		entry.Handle = handle
+		entry.PreviousHandle = account.SetHandle(handle)
+		if entry.PreviousHandle != handle {
+			slog.Info("account changed handle", "did", evt.Did, "previous", entry.PreviousHandle, "handle", handle)
+		}
+		if moved := account.CurrentDirectory(); moved != directory {
+			slog.Info("archiving account into a new directory", "did", evt.Did, "previous", directory, "directory", moved)
+			if err := a.fsClient.MkdirAll(moved, 0755); err != nil {
+				slog.Error("Error creating account directory", "error", err, "directory", moved)
+			}
+		}
+	}
+	return a.recordTimeline(account, entry)
+}
+
+func (a *Archiver) RepoAccount(evt *atproto.SyncSubscribeRepos_Account) error {
+	account, ok := a.accounts.Lookup(evt.Did)
+	if !ok {
+		return nil
+	}
+	status := ""
+	if evt.Status != nil {
+		status = *evt.Status
+	}
+	wasActive := account.Active()
+	account.SetStatus(evt.Active, status)
+
+	switch {
+	case wasActive && !evt.Active:
+		slog.Warn("account is no longer active", "did", evt.Did, "handle", account.CurrentHandle(), "status", status, "paused", a.pauseInactive)
+	case !wasActive && evt.Active:
+		slog.Info("account is active again", "did", evt.Did, "handle", account.CurrentHandle())
+	}
+
+	active := evt.Active
+	return a.recordTimeline(account, &TimelineEntry{
+		Kind:      "account",
+		Did:       evt.Did,
+		Seq:       evt.Seq,
+		EventTime: evt.Time,
+		Handle:    account.CurrentHandle(),
+		Active:    &active,
+		Status:    status,
+	})
+}
+
+func (a *Archiver) Paused(account *Account) bool {
+	return a.pauseInactive && !account.Active()
+}
+
+func (a *Archiver) resolveIdentity(evt *atproto.SyncSubscribeRepos_Identity) (string, error) {
+	if a.identities == nil {
+		if evt.Handle == nil {
+			return "", fmt.Errorf("identity event has no handle and no resolver is configured")
+		}
+		return *evt.Handle, nil
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, IdentityTimeout)
+	defer cancel()
+	return a.identities.ResolveIdentity(ctx, evt.Did)
+}
+
+func (a *Archiver) recordTimeline(account *Account, entry *TimelineEntry) error {
+	entry.RecordedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	path := filepath.Join(account.CurrentDirectory(), TimelineFilename)
+	f, err := a.fsClient.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Error opening timeline", "error", err, "path", path)
+		return nil
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		slog.Error("Error writing timeline", "error", err, "path", path)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"firehose/pkg/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	IndexFilename     = "fw.index.jsonl"
+	TombstoneFilename = "fw.tombstones.jsonl"
+	DeletedDirectory  = "deleted"
+	DeleteKeep        = "keep"
+	DeleteMove        = "move"
+	DeleteRemove      = "remove"
+)
+
+var DeletePolicies = []string{DeleteKeep, DeleteMove, DeleteRemove}
+
+type IndexEntry struct {
+	Repo       string    `json:"repo"`
+	Path       string    `json:"path"`
+	AtUri      string    `json:"atUri"`
+	Files      []string  `json:"files"`
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+type Tombstone struct {
+	Repo       string     `json:"repo"`
+	Path       string     `json:"path"`
+	AtUri      string     `json:"atUri,omitempty"`
+	Seq        int64      `json:"seq,omitempty"`
+	ArchivedAt *time.Time `json:"archivedAt,omitempty"`
+	DeletedAt  time.Time  `json:"deletedAt"`
+	Policy     string     `json:"policy"`
+	Files      []string   `json:"files,omitempty"`
+	Shared     []string   `json:"shared,omitempty"`
+}
+
+type indexRecord struct {
+	Add    *IndexEntry `json:"add,omitempty"`
+	Remove string      `json:"remove,omitempty"`
+}
+
+type RecordIndex struct {
+	fs        utils.FileSystem
+	blobs     *BlobStore
+	directory string
+	mu        sync.Mutex
+	entries   map[string]*IndexEntry
+}
+
+func OpenRecordIndex(FSClient utils.FileSystem, directory string) (*RecordIndex, error) {
+	index := &RecordIndex{fs: FSClient, directory: directory, entries: map[string]*IndexEntry{}}
+	if err := index.load(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (i *RecordIndex) WithBlobStore(store *BlobStore) *RecordIndex {
+	i.blobs = store
+	return i
+}
+
+func NewIndexEntry(repo, path string, archived *ArchivedPost, now time.Time) *IndexEntry {
+	return &IndexEntry{Repo: repo, Path: path, AtUri: archived.AtUri, Files: archived.Files, ArchivedAt: now}
+}
+
+func ParseDeletePolicy(policy string) (string, error) {
+	for _, known := range DeletePolicies {
+		if policy == known {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unknown delete policy: %s", policy)
+}
+
+func (i *RecordIndex) Lookup(repo, path string) (*IndexEntry, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	entry, ok := i.entries[indexKey(repo, path)]
+	return entry, ok
+}
+
+func (i *RecordIndex) Add(entry *IndexEntry) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.append(IndexFilename, &indexRecord{Add: entry}); err != nil {
+		return err
+	}
+	i.entries[indexKey(entry.Repo, entry.Path)] = entry
+	return nil
+}
+
+func (i *RecordIndex) Delete(op *RepoOp, policy string, now time.Time) (*Tombstone, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	tombstone := &Tombstone{Repo: op.Repo, Path: op.Path, Seq: op.Seq, DeletedAt: now, Policy: policy}
+	key := indexKey(op.Repo, op.Path)
+	entry, ok := i.entries[key]
+	if ok {
+		delete(i.entries, key)
+		if err := i.append(IndexFilename, &indexRecord{Remove: key}); err != nil {
+			return nil, err
+		}
+		tombstone.AtUri = entry.AtUri
+		tombstone.ArchivedAt = &entry.ArchivedAt
+		for _, file := range entry.Files {
+			if i.referenced(file) {
+				tombstone.Shared = append(tombstone.Shared, file)
+				continue
+			}
+			tombstone.Files = append(tombstone.Files, file)
+		}
+	}
+
+	var errs []error
+	for n, file := range tombstone.Files {
+		switch policy {
+		case DeleteMove:
+			moved, err := moveToDeleted(i.fs, file)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			tombstone.Files[n] = moved
+		case DeleteRemove:
+			if err := i.fs.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+				continue
+			}
+			if i.blobs != nil {
+				if err := i.blobs.Release(file); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if err := i.append(TombstoneFilename, tombstone); err != nil {
+		errs = append(errs, err)
+	}
+	return tombstone, errors.Join(errs...)
+}
+
+func (i *RecordIndex) referenced(file string) bool {
+	for _, entry := range i.entries {
+		for _, other := range entry.Files {
+			if other == file {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (i *RecordIndex) append(filename string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := i.fs.OpenFile(filepath.Join(i.directory, filename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (i *RecordIndex) load() error {
+	path := filepath.Join(i.directory, IndexFilename)
+	f, err := i.fs.OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record indexRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("error reading record index: %w The path: %s", err, path)
+		}
+		if record.Add != nil {
+			i.entries[indexKey(record.Add.Repo, record.Add.Path)] = record.Add
+		}
+		if record.Remove != "" {
+			delete(i.entries, record.Remove)
+		}
+	}
+	return scanner.Err()
+}
+
+func indexKey(repo, path string) string {
+	return repo + "/" + path
+}
+
+func moveToDeleted(fs utils.FileSystem, file string) (string, error) {
+	dest := filepath.Join(filepath.Dir(file), DeletedDirectory, filepath.Base(file))
+	if err := fs.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	info, err := fs.Lstat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if err := moveSymlink(fs, file, dest); err != nil {
+			return "", err
+		}
+		return dest, nil
+	}
+	if err := fs.Rename(file, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+func moveSymlink(fs utils.FileSystem, file, dest string) error {
+	target, err := fs.Readlink(file)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(target) {
+		target, err = filepath.Rel(filepath.Dir(dest), filepath.Join(filepath.Dir(file), target))
+		if err != nil {
+			return err
+		}
+	}
+	tmp := utils.TempPath(dest)
+	if err := fs.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, dest); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	return fs.Remove(file)
+}
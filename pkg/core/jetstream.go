@@ -0,0 +1,212 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	JetstreamSubscribePath = "/subscribe"
+	JetstreamKindCommit    = "commit"
+	JetstreamKindIdentity  = "identity"
+	JetstreamKindAccount   = "account"
+)
+
+type JetstreamEvent struct {
+	Did      string                               `json:"did"`
+	TimeUS   int64                                `json:"time_us"`
+	Kind     string                               `json:"kind"`
+	Commit   *JetstreamCommit                     `json:"commit,omitempty"`
+	Identity *atproto.SyncSubscribeRepos_Identity `json:"identity,omitempty"`
+	Account  *atproto.SyncSubscribeRepos_Account  `json:"account,omitempty"`
+}
+
+type JetstreamCommit struct {
+	Rev        string          `json:"rev"`
+	Operation  string          `json:"operation"`
+	Collection string          `json:"collection"`
+	Rkey       string          `json:"rkey"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	Cid        string          `json:"cid,omitempty"`
+}
+
+type Jetstream struct {
+	Hosts             []string
+	Cursor            *Cursor
+	Dialer            Dialer
+	Handler           func(ctx context.Context, evt *JetstreamEvent) error
+	WantedDids        []string
+	WantedCollections []string
+	Dictionary        []byte
+	IdleTimeout       time.Duration
+	supervisor        *supervisor
+}
+
+func LoadZstdDictionary(path string) ([]byte, error) {
+	dictionary, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading zstd dictionary: %w The path: %s", err, path)
+	}
+	return dictionary, nil
+}
+
+func (js *Jetstream) Run(ctx context.Context) error {
+	return js.state().run(ctx, js.session)
+}
+
+func (js *Jetstream) Host() string {
+	return js.state().host()
+}
+
+func (js *Jetstream) state() *supervisor {
+	if js.supervisor == nil {
+		js.supervisor = &supervisor{name: "jetstream", hosts: js.Hosts, cursor: js.Cursor}
+	}
+	return js.supervisor
+}
+
+func (js *Jetstream) uri(host string) string {
+	query := url.Values{}
+	for _, did := range js.WantedDids {
+		query.Add("wantedDids", did)
+	}
+	for _, collection := range js.WantedCollections {
+		query.Add("wantedCollections", collection)
+	}
+	if js.Dictionary != nil {
+		query.Set("compress", "true")
+	}
+	if seq := js.Cursor.SeqFor(host); seq >= 0 {
+		query.Set("cursor", fmt.Sprintf("%d", seq))
+	}
+	uri := host + JetstreamSubscribePath
+	if encoded := query.Encode(); encoded != "" {
+		uri = uri + "?" + encoded
+	}
+	return uri
+}
+
+func (js *Jetstream) session(ctx context.Context, host string) error {
+	var decoder *zstd.Decoder
+	if js.Dictionary != nil {
+		var err error
+		decoder, err = zstd.NewReader(nil, zstd.WithDecoderDicts(js.Dictionary))
+		if err != nil {
+			return fmt.Errorf("error creating zstd decoder: %w", err)
+		}
+		defer decoder.Close()
+	}
+
+	uri := js.uri(host)
+	slog.Info("connecting to jetstream", "uri", uri)
+	con, _, err := js.Dialer.Dial(uri, http.Header{})
+	if err != nil {
+		return fmt.Errorf("websocket dial error: %w", err)
+	}
+	defer con.Close()
+	js.Cursor.SwitchHost(host)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		con.Close()
+	}()
+
+	clock := newFrameClock()
+	keepAlive(ctx, con, host, js.IdleTimeout, clock)
+
+	received := false
+	for {
+		mt, message, err := con.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !received {
+				return fmt.Errorf("%w: %w", errNoFrames, err)
+			}
+			slog.Warn("jetstream connection dropped", "host", host, "cursor", js.Cursor.Seq(), "error", err)
+			return nil
+		}
+		clock.touch()
+
+		if mt == websocket.BinaryMessage && decoder != nil {
+			message, err = decoder.DecodeAll(message, nil)
+			if err != nil {
+				return fmt.Errorf("error decompressing jetstream event: %w", err)
+			}
+		}
+
+		var evt JetstreamEvent
+		if err := json.Unmarshal(message, &evt); err != nil {
+			slog.Error("error decoding jetstream event", "error", err)
+			continue
+		}
+		received = true
+
+		clock.pause()
+		err = js.Handler(ctx, &evt)
+		clock.resume()
+		if err != nil {
+			return err
+		}
+		js.Cursor.Set(evt.TimeUS)
+	}
+}
+
+func (evt *JetstreamEvent) RepoOp() (*RepoOp, error) {
+	if evt.Kind != JetstreamKindCommit || evt.Commit == nil {
+		return nil, errors.New("jetstream event is not a commit")
+	}
+	op := &RepoOp{
+		Seq:    evt.TimeUS,
+		Repo:   evt.Did,
+		Rev:    evt.Commit.Rev,
+		Action: evt.Commit.Operation,
+		Path:   fmt.Sprintf("%s/%s", evt.Commit.Collection, evt.Commit.Rkey),
+		Cid:    evt.Commit.Cid,
+	}
+	if len(evt.Commit.Record) > 0 {
+		value, err := lexutil.JsonDecodeValue(evt.Commit.Record)
+		if err != nil {
+			slog.Warn("error decoding jetstream record, falling back to getRecord", "path", op.Path, "error", err)
+			return op, nil
+		}
+		if record, ok := value.(lexutil.CBOR); ok {
+			op.Record = record
+		}
+	}
+	return op, nil
+}
+
+func (a *Archiver) JetstreamEvent(ctx context.Context, evt *JetstreamEvent) error {
+	if !a.Watches(evt.Did) {
+		return nil
+	}
+	switch {
+	case evt.Kind == JetstreamKindIdentity && evt.Identity != nil:
+		return a.RepoIdentity(evt.Identity)
+	case evt.Kind == JetstreamKindAccount && evt.Account != nil:
+		return a.RepoAccount(evt.Account)
+	case evt.Kind == JetstreamKindCommit:
+		op, err := evt.RepoOp()
+		if err != nil {
+			return err
+		}
+		a.Archive(ctx, op)
+	}
+	return nil
+}
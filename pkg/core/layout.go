@@ -0,0 +1,96 @@
+package core
+
+import (
+	"firehose/pkg/utils"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+var defaultLayout = utils.MustParsePathTemplate(utils.DefaultPathTemplate)
+
+type blobFile struct {
+	Cid  string
+	Ext  string
+	Path string
+	Item utils.MediaItem
+}
+
+func blobFiles(layout *utils.PathTemplate, media *utils.Media, postDetails *PostDetails, directory string) []blobFile {
+	var files []blobFile
+	for _, item := range media.Items {
+		files = append(files, blobFile{
+			Cid:  item.Cid,
+			Ext:  item.Ext(),
+			Path: mediaFilename(layout, postDetails, directory, item, item.Ext()),
+			Item: item,
+		})
+	}
+	return files
+}
+
+func altTextFilename(layout *utils.PathTemplate, postDetails *PostDetails, directory string, item utils.MediaItem) string {
+	return mediaFilename(layout, postDetails, directory, item, item.Ext()+".txt")
+}
+
+func mediaFilename(layout *utils.PathTemplate, postDetails *PostDetails, directory string, item utils.MediaItem, ext string) string {
+	vars := pathVars(postDetails)
+	vars.Cid = item.Cid
+	vars.Index = item.Index
+	vars.Ext = ext
+	if item.Lang != "" {
+		vars.Lang = item.Lang
+	}
+	return pathLayout(layout).Render(directory, vars, utils.MaxSegmentBytes)
+}
+
+func metadataFilename(layout *utils.PathTemplate, postDetails *PostDetails, directory string) string {
+	vars := pathVars(postDetails)
+	vars.Cid = postDetails.Cid
+	vars.Ext = "json"
+	return pathLayout(layout).Render(directory, vars, utils.MaxSegmentBytes)
+}
+
+func pathLayout(layout *utils.PathTemplate) *utils.PathTemplate {
+	if layout == nil {
+		return defaultLayout
+	}
+	return layout
+}
+
+func pathVars(postDetails *PostDetails) *utils.PathVars {
+	vars := &utils.PathVars{
+		AuthorDid:     postDetails.Repo,
+		AuthorHandle:  accountName(postDetails.Repo, postDetails.Handle),
+		Rkey:          postDetails.Rkey,
+		Text:          postDetails.Text,
+		SourceCreated: parseDatetime(postDetails.SourceCreatedAt),
+		Archived:      postDetails.ArchivedAt,
+	}
+	if post := postDetails.Response; post != nil {
+		vars.Created = parseDatetime(post.CreatedAt)
+		if len(post.Langs) > 0 {
+			vars.Lang = post.Langs[0]
+		}
+	}
+	if source := postDetails.Source; source != nil {
+		vars.AccountDid = source.Repo
+		vars.AccountHandle = accountName(source.Repo, source.Handle)
+		if repoPath, err := ParseRepoPath(source.Path); err == nil {
+			vars.Kind = collectionName(repoPath.Collection.String())
+			vars.SourceRkey = repoPath.Rkey.String()
+		}
+	}
+	return vars
+}
+
+func parseDatetime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	datetime, err := syntax.ParseDatetimeLenient(value)
+	if err != nil {
+		return time.Time{}
+	}
+	return datetime.Time()
+}
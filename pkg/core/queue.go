@@ -0,0 +1,278 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"firehose/pkg/utils"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	QueueFilename = "fw.queue.jsonl"
+	CompactEvery  = 1000
+)
+
+type Job struct {
+	ID uint64  `json:"id"`
+	Op *RepoOp `json:"op"`
+}
+
+type journalEntry struct {
+	Add  *Job   `json:"add,omitempty"`
+	Done uint64 `json:"done,omitempty"`
+}
+
+type Queue struct {
+	fs          utils.FileSystem
+	path        string
+	mu          sync.Mutex
+	journal     utils.File
+	nextID      uint64
+	outstanding map[uint64]*Job
+	completed   int
+	jobs        chan *Job
+	depth       atomic.Int64
+	inFlight    atomic.Int64
+	wg          sync.WaitGroup
+}
+
+func OpenQueue(FSClient utils.FileSystem, path string, capacity int) (*Queue, error) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	q := &Queue{fs: FSClient, path: path, outstanding: map[uint64]*Job{}}
+	if path != "" {
+		if err := q.replay(); err != nil {
+			return nil, err
+		}
+		if err := q.compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	replayed := q.sorted()
+	q.jobs = make(chan *Job, capacity+len(replayed))
+	for _, job := range replayed {
+		q.wg.Add(1)
+		q.depth.Add(1)
+		q.jobs <- job
+	}
+	if len(replayed) > 0 {
+		slog.Info("resuming queued jobs from journal", "count", len(replayed), "queue-file", path)
+	}
+	return q, nil
+}
+
+func (q *Queue) Push(ctx context.Context, op *RepoOp) error {
+	q.mu.Lock()
+	q.nextID++
+	job := &Job{ID: q.nextID, Op: op}
+	if err := q.append(journalEntry{Add: job}, true); err != nil {
+		q.mu.Unlock()
+		return fmt.Errorf("error writing queue journal: %w The path: %s", err, q.path)
+	}
+	q.outstanding[job.ID] = job
+	q.mu.Unlock()
+
+	q.wg.Add(1)
+	q.depth.Add(1)
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+	}
+	slog.Warn("queue is full, applying backpressure", "depth", q.Depth(), "in-flight", q.InFlight())
+	select {
+	case q.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		q.depth.Add(-1)
+		q.wg.Done()
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) Next(stop <-chan struct{}) (*Job, bool) {
+	select {
+	case <-stop:
+		return nil, false
+	case job := <-q.jobs:
+		q.depth.Add(-1)
+		select {
+		case <-stop:
+			q.wg.Done()
+			return nil, false
+		default:
+		}
+		q.inFlight.Add(1)
+		return job, true
+	}
+}
+
+func (q *Queue) Done(job *Job) {
+	defer q.wg.Done()
+	defer q.inFlight.Add(-1)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.outstanding, job.ID)
+	if err := q.append(journalEntry{Done: job.ID}, false); err != nil {
+		slog.Error("error writing queue journal", "error", err, "path", q.path)
+	}
+	q.completed++
+	if q.journal != nil && q.completed >= CompactEvery {
+		if err := q.compact(); err != nil {
+			slog.Error("error compacting queue journal", "error", err, "path", q.path)
+		}
+	}
+}
+
+func (q *Queue) Abandon(job *Job) {
+	q.inFlight.Add(-1)
+	q.wg.Done()
+}
+
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+func (q *Queue) Depth() int64 {
+	return q.depth.Load()
+}
+
+func (q *Queue) InFlight() int64 {
+	return q.inFlight.Load()
+}
+
+func (q *Queue) Pending() []*RepoOp {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ops := []*RepoOp{}
+	for _, job := range q.sorted() {
+		ops = append(ops, job.Op)
+	}
+	return ops
+}
+
+func (q *Queue) Outstanding(repo, path string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.outstanding {
+		if job.Op.Repo == repo && job.Op.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Queue) LogStats() {
+	slog.Info("queue stats", "depth", q.Depth(), "in-flight", q.InFlight(), "outstanding", len(q.Pending()))
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.journal == nil {
+		return nil
+	}
+	if err := q.compact(); err != nil {
+		return err
+	}
+	err := q.journal.Close()
+	q.journal = nil
+	return err
+}
+
+func (q *Queue) replay() error {
+	f, err := q.fs.OpenFile(q.path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			slog.Warn("skipping unreadable queue journal entry", "error", err, "path", q.path)
+			continue
+		}
+		switch {
+		case entry.Add != nil && entry.Add.Op != nil:
+			q.outstanding[entry.Add.ID] = entry.Add
+			q.nextID = max(q.nextID, entry.Add.ID)
+		case entry.Done != 0:
+			delete(q.outstanding, entry.Done)
+		}
+	}
+	return scanner.Err()
+}
+
+func (q *Queue) compact() error {
+	if q.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, job := range q.sorted() {
+		if err := encoder.Encode(journalEntry{Add: job}); err != nil {
+			return err
+		}
+	}
+	if q.journal != nil {
+		q.journal.Close()
+		q.journal = nil
+	}
+	if err := utils.WriteFileAtomic(q.fs, q.path, buf.Bytes()); err != nil {
+		return err
+	}
+	journal, err := q.fs.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	q.journal = journal
+	q.completed = 0
+	return nil
+}
+
+func (q *Queue) append(entry journalEntry, sync bool) error {
+	if q.journal == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := q.journal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if sync {
+		return q.journal.Sync()
+	}
+	return nil
+}
+
+func (q *Queue) sorted() []*Job {
+	jobs := make([]*Job, 0, len(q.outstanding))
+	for _, job := range q.outstanding {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
@@ -5,41 +5,189 @@ import (
 	"firehose/pkg/api"
 	"firehose/pkg/utils"
 	"log/slog"
-	"strings"
 	"sync"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
 )
 
-func RepoCommit(
-	did *atproto.IdentityResolveHandle_Output,
-	directory string,
+type RepoOp struct {
+	Seq    int64        `json:"seq"`
+	Repo   string       `json:"repo"`
+	Rev    string       `json:"rev"`
+	Action string       `json:"action"`
+	Path   string       `json:"path"`
+	Handle string       `json:"handle,omitempty"`
+	Cid    string       `json:"cid,omitempty"`
+	Record lexutil.CBOR `json:"-"`
+}
+
+type Archiver struct {
+	accounts       *Accounts
+	apiClient      api.APIClient
+	fsClient       utils.FileSystem
+	downloadClient DownloadClient
+	collections    *CollectionRegistry
+	queue          *Queue
+	deadLetters    *DeadLetterStore
+	index          *RecordIndex
+	deletePolicy   string
+	deletesMu      sync.Mutex
+	pendingDeletes map[string]*RepoOp
+	identities     IdentityResolver
+	pauseInactive  bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	stop           chan struct{}
+	workers        sync.WaitGroup
+}
+
+func NewArchiver(
+	accounts *Accounts,
 	APIClient api.APIClient,
 	FSClient utils.FileSystem,
 	downloadClient DownloadClient,
-	semaphore *chan struct{},
-	wg *sync.WaitGroup,
-) *events.RepoStreamCallbacks {
+	collections *CollectionRegistry,
+	queue *Queue,
+	workers int,
+) *Archiver {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Archiver{
+		accounts:       accounts,
+		apiClient:      APIClient,
+		fsClient:       FSClient,
+		downloadClient: downloadClient,
+		collections:    collections,
+		queue:          queue,
+		pendingDeletes: map[string]*RepoOp{},
+		ctx:            ctx,
+		cancel:         cancel,
+		stop:           make(chan struct{}),
+	}
+	a.start(workers)
+	return a
+}
+
+func (a *Archiver) Callbacks() *events.RepoStreamCallbacks {
 	return &events.RepoStreamCallbacks{
-		RepoCommit: func(evt *atproto.SyncSubscribeRepos_Commit) error {
-			if evt.Repo != did.Did {
-				return nil
-			}
-			for _, op := range evt.Ops {
-				if op.Action == "create" && strings.Contains(op.Path, "feed") {
-					wg.Add(1)
-					go func(path string) {
-						(*semaphore) <- struct{}{}
-						defer func() { <-(*semaphore) }()
-						defer wg.Done()
-						DownloadPost(context.Background(), downloadClient, APIClient, FSClient, evt.Repo, path, directory)
-					}(op.Path)
-				} else {
-					slog.Info("Operation received", "action", op.Action, "path", op.Path)
-				}
+		RepoCommit:   a.RepoCommit,
+		RepoIdentity: a.RepoIdentity,
+		RepoAccount:  a.RepoAccount,
+	}
+}
+
+func (a *Archiver) Watches(repo string) bool {
+	_, ok := a.accounts.Lookup(repo)
+	return ok
+}
+
+func (a *Archiver) Accounts() *Accounts {
+	return a.accounts
+}
+
+func (a *Archiver) Wants(op *RepoOp) bool {
+	return op.Action == "create" && isArchivable(a.collections, op.Path)
+}
+
+func (a *Archiver) WantsDelete(op *RepoOp) bool {
+	return op.Action == "delete" && a.index != nil && isArchivable(a.collections, op.Path)
+}
+
+func (a *Archiver) EventHandler(ctx context.Context, xev *events.XRPCStreamEvent) error {
+	if xev.RepoCommit != nil {
+		return a.Commit(ctx, xev.RepoCommit)
+	}
+	return a.Callbacks().EventHandler(ctx, xev)
+}
+
+func (a *Archiver) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
+	return a.Commit(a.ctx, evt)
+}
+
+func (a *Archiver) Commit(ctx context.Context, evt *atproto.SyncSubscribeRepos_Commit) error {
+	if !a.Watches(evt.Repo) {
+		return nil
+	}
+	var blocks *CommitBlocks
+	loaded := false
+	for _, op := range evt.Ops {
+		repoOp := &RepoOp{
+			Seq:    evt.Seq,
+			Repo:   evt.Repo,
+			Rev:    evt.Rev,
+			Action: op.Action,
+			Path:   op.Path,
+		}
+		if op.Cid != nil {
+			repoOp.Cid = op.Cid.String()
+		}
+		if a.Wants(repoOp) {
+			if !loaded {
+				blocks = readCommitBlocks(evt)
+				loaded = true
 			}
-			return nil
-		},
+			repoOp.Record = opRecord(blocks, op)
+		}
+		a.Archive(ctx, repoOp)
+	}
+	return nil
+}
+
+func (a *Archiver) Archive(ctx context.Context, op *RepoOp) {
+	account, ok := a.accounts.Lookup(op.Repo)
+	if !ok {
+		return
+	}
+	account.Stats.Seen.Add(1)
+	op.Handle = account.CurrentHandle()
+	if a.WantsDelete(op) {
+		a.RecordDelete(op, account)
+		return
+	}
+	if !a.Wants(op) {
+		slog.Info("Operation received", "action", op.Action, "path", op.Path, "did", op.Repo)
+		return
+	}
+	if a.Paused(account) {
+		slog.Info("account is inactive, skipping operation", "action", op.Action, "path", op.Path, "did", op.Repo, "status", account.Status())
+		return
+	}
+	if err := a.queue.Push(ctx, op); err != nil {
+		slog.Error("Error queueing operation", "error", err, "path", op.Path, "did", op.Repo)
+	}
+}
+
+func isArchivable(collections *CollectionRegistry, path string) bool {
+	repoPath, err := ParseRepoPath(path)
+	if err != nil {
+		return false
+	}
+	_, ok := collections.Lookup(repoPath.Collection)
+	return ok
+}
+
+func readCommitBlocks(evt *atproto.SyncSubscribeRepos_Commit) *CommitBlocks {
+	if evt.TooBig || len(evt.Blocks) == 0 {
+		slog.Info("commit has no usable blocks, falling back to getRecord", "repo", evt.Repo, "rev", evt.Rev, "tooBig", evt.TooBig)
+		return nil
+	}
+	blocks, err := ReadCommitBlocks(context.Background(), evt.Blocks)
+	if err != nil {
+		slog.Warn("error reading commit blocks, falling back to getRecord", "repo", evt.Repo, "rev", evt.Rev, "error", err)
+		return nil
+	}
+	return blocks
+}
+
+func opRecord(blocks *CommitBlocks, op *atproto.SyncSubscribeRepos_RepoOp) lexutil.CBOR {
+	if blocks == nil {
+		return nil
+	}
+	record, err := blocks.OpRecord(context.Background(), op)
+	if err != nil {
+		slog.Warn("error decoding record from commit, falling back to getRecord", "path", op.Path, "error", err)
+		return nil
 	}
+	return record
 }
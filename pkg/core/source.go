@@ -0,0 +1,174 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"firehose/pkg/api"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	MaxHostFailures = 3
+)
+
+type EventSource interface {
+	Run(ctx context.Context) error
+}
+
+type Dialer interface {
+	Dial(urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)
+}
+
+var errNoFrames = errors.New("connection closed before any events were received")
+
+type supervisor struct {
+	name     string
+	hosts    []string
+	cursor   *Cursor
+	current  int
+	failures int
+}
+
+func (s *supervisor) host() string {
+	return s.hosts[s.current]
+}
+
+func (s *supervisor) run(ctx context.Context, session func(ctx context.Context, host string) error) error {
+	if len(s.hosts) == 0 {
+		return errors.New("no hosts configured for " + s.name)
+	}
+	notify := backoff.WithNotify(func(err error, next time.Duration) {
+		slog.Warn("connection failed, attempting to reconnect", "source", s.name, "host", s.host(), "retry-after", next.Seconds(), "cursor", s.cursor.Seq(), "error", err.Error())
+	})
+	for {
+		_, err := backoff.Retry(ctx, func() (struct{}, error) {
+			err := session(ctx, s.host())
+			s.recordOutcome(err)
+			return struct{}{}, err
+		}, backoff.WithBackOff(api.NewBackOff()), backoff.WithMaxElapsedTime(0), notify)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("reconnecting", "source", s.name, "host", s.host(), "cursor", s.cursor.Seq())
+	}
+}
+
+func (s *supervisor) recordOutcome(err error) {
+	if err == nil {
+		s.failures = 0
+		return
+	}
+	if errors.Is(err, errNoFrames) {
+		return
+	}
+	s.failures++
+	if s.failures >= MaxHostFailures && s.current < len(s.hosts)-1 {
+		slog.Warn("host keeps failing, falling back to next host", "source", s.name, "from", s.host(), "to", s.hosts[s.current+1], "failures", s.failures)
+		s.current++
+		s.failures = 0
+	}
+}
+
+type frameClock struct {
+	last   atomic.Int64
+	paused atomic.Bool
+}
+
+func newFrameClock() *frameClock {
+	c := &frameClock{}
+	c.touch()
+	return c
+}
+
+func (c *frameClock) touch() {
+	c.last.Store(time.Now().UnixNano())
+}
+
+func (c *frameClock) pause() {
+	c.paused.Store(true)
+}
+
+func (c *frameClock) resume() {
+	c.touch()
+	c.paused.Store(false)
+}
+
+func (c *frameClock) idle() time.Duration {
+	if c.paused.Load() {
+		return 0
+	}
+	return time.Since(time.Unix(0, c.last.Load()))
+}
+
+func keepAlive(ctx context.Context, con *websocket.Conn, host string, idleTimeout time.Duration, clock *frameClock) {
+	touch := func(string) error {
+		clock.touch()
+		return nil
+	}
+	pong := con.PingHandler()
+	con.SetPingHandler(func(message string) error {
+		touch(message)
+		return pong(message)
+	})
+	con.SetPongHandler(touch)
+	if idleTimeout <= 0 {
+		return
+	}
+	go ping(ctx, con, host, idleTimeout/2)
+	go watchdog(ctx, con, host, idleTimeout, clock)
+}
+
+func ping(ctx context.Context, con *websocket.Conn, host string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := con.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
+				slog.Warn("failed to ping", "host", host, "error", err)
+			}
+		}
+	}
+}
+
+func watchdog(ctx context.Context, con *websocket.Conn, host string, idleTimeout time.Duration, clock *frameClock) {
+	t := time.NewTicker(idleTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			idle := clock.idle()
+			if idle > idleTimeout {
+				slog.Warn("no frames received, forcing reconnect", "host", host, "idle", idle.Seconds())
+				con.Close()
+				return
+			}
+		}
+	}
+}
+
+func WebsocketHost(endpoint string) string {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	switch {
+	case strings.HasPrefix(endpoint, "https://"):
+		return "wss://" + strings.TrimPrefix(endpoint, "https://")
+	case strings.HasPrefix(endpoint, "http://"):
+		return "ws://" + strings.TrimPrefix(endpoint, "http://")
+	default:
+		return endpoint
+	}
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"errors"
+	"firehose/pkg/api"
+	"firehose/pkg/utils"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	BlobOK       = "ok"
+	BlobMissing  = "missing"
+	BlobMismatch = "mismatch"
+)
+
+type BlobCheck struct {
+	Metadata    string
+	Path        string
+	Cid         string
+	Status      string
+	Quarantined string
+}
+
+func VerifyArchive(FSClient utils.FileSystem, layout *utils.PathTemplate, directory string, quarantine bool) ([]*BlobCheck, error) {
+	var checks []*BlobCheck
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == utils.QuarantineDirectory {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".json" || strings.HasPrefix(entry.Name(), "fw.") {
+			return nil
+		}
+		postChecks, err := VerifyPost(FSClient, layout, path, quarantine)
+		if err != nil {
+			slog.Error("error verifying post", "error", err, "path", path)
+			return nil
+		}
+		checks = append(checks, postChecks...)
+		return nil
+	})
+	return checks, err
+}
+
+func VerifyPost(FSClient utils.FileSystem, layout *utils.PathTemplate, metadataPath string, quarantine bool) ([]*BlobCheck, error) {
+	envelope, postDetails, err := readPostMetadata(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+	if postDetails.Media == nil {
+		return nil, nil
+	}
+
+	var checks []*BlobCheck
+	for _, blob := range recordedBlobFiles(layout, envelope, postDetails, metadataPath) {
+		check := &BlobCheck{Metadata: metadataPath, Path: blob.Path, Cid: blob.Cid}
+		checks = append(checks, check)
+
+		err := verifyBlobFile(blob.Path, blob.Cid)
+		switch {
+		case err == nil:
+			check.Status = BlobOK
+			continue
+		case errors.Is(err, os.ErrNotExist):
+			check.Status = BlobMissing
+			continue
+		case !errors.Is(err, api.ErrCIDMismatch):
+			return checks, err
+		}
+
+		check.Status = BlobMismatch
+		slog.Warn("blob does not match its CID", "path", blob.Path, "cid", blob.Cid)
+		if quarantine {
+			dest, err := utils.QuarantineFile(FSClient, blob.Path)
+			if err != nil {
+				return checks, fmt.Errorf("error quarantining blob: %w The path: %s", err, blob.Path)
+			}
+			check.Quarantined = dest
+		}
+	}
+	return checks, nil
+}
+
+func verifyBlobFile(path, cid string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return api.VerifyBlob(f, cid)
+}
+
+func readPostMetadata(path string) (*Envelope, *PostDetails, error) {
+	envelope, err := LoadEnvelope(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if envelope.Post == nil {
+		return nil, nil, fmt.Errorf("metadata has no post record: %s", path)
+	}
+
+	postDetails := &PostDetails{
+		Repo:            envelope.Author.Did,
+		Handle:          envelope.Author.Handle,
+		Text:            envelope.Post.Text,
+		Cid:             envelope.Cid,
+		Response:        envelope.Post,
+		SourceCreatedAt: envelope.Source.CreatedAt,
+	}
+	if envelope.ArchivedAt != nil {
+		postDetails.ArchivedAt = *envelope.ArchivedAt
+	}
+	if envelope.Source.Collection != "" {
+		postDetails.Source = &RepoOp{
+			Repo: envelope.Source.Repo,
+			Path: envelope.Source.Collection + "/" + envelope.Source.Rkey,
+			Seq:  envelope.Source.Seq,
+			Rev:  envelope.Source.Rev,
+		}
+	}
+	if envelope.Uri != "" {
+		postDetails.Rkey = utils.FindExpression("[^/]*$", envelope.Uri)
+	}
+	if postDetails.Rkey == "" || postDetails.Handle == "" {
+		parts := strings.SplitN(strings.TrimSuffix(filepath.Base(path), ".json"), "_", 3)
+		if len(parts) < 2 {
+			return nil, nil, fmt.Errorf("metadata filename is not <rkey>_<handle>_<text>.json: %s", path)
+		}
+		postDetails.Rkey = parts[0]
+		postDetails.Handle = parts[1]
+	}
+	if envelope.Post.Embed != nil {
+		postDetails.Media = utils.ExtractMedia(envelope.Post.Embed)
+	}
+	return envelope, postDetails, nil
+}
+
+func recordedBlobFiles(layout *utils.PathTemplate, envelope *Envelope, postDetails *PostDetails, metadataPath string) []blobFile {
+	blobs := blobFiles(layout, postDetails.Media, postDetails, archiveRoot(layout, metadataPath, postDetails))
+	for i := range blobs {
+		if i < len(envelope.Media) && envelope.Media[i].Path != "" {
+			blobs[i].Path = filepath.Join(filepath.Dir(metadataPath), filepath.FromSlash(envelope.Media[i].Path))
+		}
+	}
+	return blobs
+}
+
+func archiveRoot(layout *utils.PathTemplate, metadataPath string, postDetails *PostDetails) string {
+	for root := filepath.Dir(metadataPath); ; root = filepath.Dir(root) {
+		if metadataFilename(layout, postDetails, root) == metadataPath {
+			return root
+		}
+		if parent := filepath.Dir(root); parent == root {
+			return filepath.Dir(metadataPath)
+		}
+	}
+}
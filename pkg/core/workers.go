@@ -0,0 +1,100 @@
+package core
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	ShutdownGrace = 5 * time.Second
+)
+
+func (a *Archiver) start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for range workers {
+		a.workers.Add(1)
+		go a.work()
+	}
+}
+
+func (a *Archiver) work() {
+	defer a.workers.Done()
+	for {
+		job, ok := a.queue.Next(a.stop)
+		if !ok {
+			return
+		}
+		a.process(job)
+	}
+}
+
+func (a *Archiver) process(job *Job) {
+	op := job.Op
+	account, ok := a.accounts.Lookup(op.Repo)
+	if !ok {
+		slog.Info("dropping queued operation for an account that is no longer watched", "path", op.Path, "did", op.Repo)
+		a.finish(job, nil)
+		return
+	}
+	if a.deletePending(op) {
+		slog.Info("record deleted before it was downloaded, skipping", "path", op.Path, "did", op.Repo)
+		a.finish(job, account)
+		return
+	}
+	directory := account.CurrentDirectory()
+	archived, err := ArchivePost(a.ctx, a.downloadClient, a.apiClient, a.fsClient, op, directory)
+	if err != nil && a.ctx.Err() != nil {
+		slog.Warn("download cut off by shutdown", "path", op.Path, "did", op.Repo)
+		a.queue.Abandon(job)
+		return
+	}
+	if err != nil {
+		account.Stats.Failed.Add(1)
+		a.deadLetter(op, directory, err)
+	} else {
+		account.Stats.Archived.Add(1)
+		a.indexArchived(op, archived)
+	}
+	a.finish(job, account)
+}
+
+func (a *Archiver) WithDeadLetters(store *DeadLetterStore) *Archiver {
+	a.deadLetters = store
+	return a
+}
+
+func (a *Archiver) deadLetter(op *RepoOp, directory string, err error) {
+	if a.deadLetters == nil {
+		return
+	}
+	letter := NewDeadLetter(op, directory, err, time.Now().UTC())
+	slog.Warn("download failed, recorded in dead letters", "path", op.Path, "did", op.Repo, "aturi", letter.AtUri, "class", letter.Class)
+	if err := a.deadLetters.Add(letter); err != nil {
+		slog.Error("Error recording dead letter", "error", err, "path", op.Path, "did", op.Repo)
+	}
+}
+
+func (a *Archiver) Shutdown(timeout time.Duration) []*RepoOp {
+	close(a.stop)
+	done := make(chan struct{})
+	go func() {
+		a.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("shutdown deadline reached, cancelling in-flight downloads", "in-flight", a.queue.InFlight())
+		a.cancel()
+		select {
+		case <-done:
+		case <-time.After(ShutdownGrace):
+			slog.Warn("downloads did not stop after cancellation", "in-flight", a.queue.InFlight())
+		}
+	}
+	a.cancel()
+	return a.queue.Pending()
+}
@@ -2,12 +2,36 @@ package utils
 
 import (
 	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+const (
+	MediaImage   = "image"
+	MediaVideo   = "video"
+	MediaCaption = "caption"
 )
 
 type Media struct {
-	VideoCid  string
-	ImageCid  []string
-	MediaType string
+	Items []MediaItem
+}
+
+type MediaItem struct {
+	Kind        string       `json:"kind"`
+	Cid         string       `json:"cid"`
+	MimeType    string       `json:"mimeType,omitempty"`
+	Alt         string       `json:"alt,omitempty"`
+	Lang        string       `json:"lang,omitempty"`
+	AspectRatio *AspectRatio `json:"aspectRatio,omitempty"`
+	Index       int          `json:"index,omitempty"`
+}
+
+type AspectRatio struct {
+	Width  int64 `json:"width"`
+	Height int64 `json:"height"`
+}
+
+func (m MediaItem) Ext() string {
+	return FindExpression("[^/]*$", m.MimeType)
 }
 
 func ExtractMedia(record *bsky.FeedPost_Embed) *Media {
@@ -15,31 +39,70 @@ func ExtractMedia(record *bsky.FeedPost_Embed) *Media {
 	if record.EmbedRecordWithMedia != nil {
 		media := record.EmbedRecordWithMedia.Media
 		if media.EmbedImages != nil {
-			for _, image := range media.EmbedImages.Images {
-				extractedMedia.ImageCid = append(extractedMedia.ImageCid, image.Image.Ref.String())
-			}
-			mimeType := media.EmbedImages.Images[0].Image.MimeType
-			extractedMedia.MediaType = FindExpression("[^/]*$", mimeType)
+			extractedMedia.Items = append(extractedMedia.Items, imageItems(media.EmbedImages)...)
 		}
 		if media.EmbedVideo != nil {
-			extractedMedia.VideoCid = media.EmbedVideo.Video.Ref.String()
-			mimeType := media.EmbedVideo.Video.MimeType
-			extractedMedia.MediaType = FindExpression("[^/]*$", mimeType)
+			extractedMedia.Items = append(extractedMedia.Items, videoItems(media.EmbedVideo)...)
 		}
 	}
 	if record.EmbedImages != nil {
-		for _, image := range record.EmbedImages.Images {
-			extractedMedia.ImageCid = append(extractedMedia.ImageCid, image.Image.Ref.String())
-		}
-		mimeType := record.EmbedImages.Images[0].Image.MimeType
-		extractedMedia.MediaType = FindExpression("[^/]*$", mimeType)
+		extractedMedia.Items = append(extractedMedia.Items, imageItems(record.EmbedImages)...)
 	}
 	if record.EmbedVideo != nil {
-		extractedMedia.VideoCid = record.EmbedVideo.Video.Ref.String()
-
-		mimeType := record.EmbedVideo.Video.MimeType
-		extractedMedia.MediaType = FindExpression("[^/]*$", mimeType)
+		extractedMedia.Items = append(extractedMedia.Items, videoItems(record.EmbedVideo)...)
 	}
 
 	return &extractedMedia
 }
+
+func imageItems(embed *bsky.EmbedImages) []MediaItem {
+	var items []MediaItem
+	for i, image := range embed.Images {
+		if image.Image == nil {
+			continue
+		}
+		item := blobItem(MediaImage, image.Image)
+		item.Alt = image.Alt
+		item.AspectRatio = aspectRatio(image.AspectRatio)
+		if len(embed.Images) > 1 {
+			item.Index = i + 1
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func videoItems(embed *bsky.EmbedVideo) []MediaItem {
+	if embed.Video == nil {
+		return nil
+	}
+	video := blobItem(MediaVideo, embed.Video)
+	if embed.Alt != nil {
+		video.Alt = *embed.Alt
+	}
+	video.AspectRatio = aspectRatio(embed.AspectRatio)
+	items := []MediaItem{video}
+	for i, caption := range embed.Captions {
+		if caption.File == nil {
+			continue
+		}
+		item := blobItem(MediaCaption, caption.File)
+		item.Lang = caption.Lang
+		if len(embed.Captions) > 1 {
+			item.Index = i + 1
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func blobItem(kind string, blob *util.LexBlob) MediaItem {
+	return MediaItem{Kind: kind, Cid: blob.Ref.String(), MimeType: blob.MimeType}
+}
+
+func aspectRatio(ratio *bsky.EmbedDefs_AspectRatio) *AspectRatio {
+	if ratio == nil {
+		return nil
+	}
+	return &AspectRatio{Width: ratio.Width, Height: ratio.Height}
+}
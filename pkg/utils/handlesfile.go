@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+func ReadHandlesFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var handles []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		handles = append(handles, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return handles, nil
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	PartialSuffix = ".part"
+	partialFlags  = os.O_CREATE | os.O_RDWR | os.O_APPEND
+)
+
+type PartialFile struct {
+	fs   FileSystem
+	path string
+	file File
+	size int64
+}
+
+func PartialPath(path string) string {
+	sum := sha256.Sum256([]byte(filepath.Base(path)))
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf("%s%x%s", TempPrefix, sum[:8], PartialSuffix))
+}
+
+func OpenPartial(fs FileSystem, path string) (*PartialFile, error) {
+	var size int64
+	info, err := fs.Stat(PartialPath(path))
+	switch {
+	case err == nil:
+		size = info.Size()
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	file, err := fs.OpenFile(PartialPath(path), partialFlags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialFile{fs: fs, path: path, file: file, size: size}, nil
+}
+
+func (p *PartialFile) Size() int64 {
+	return p.size
+}
+
+func (p *PartialFile) Existing() io.Reader {
+	return io.LimitReader(p.file, p.size)
+}
+
+func (p *PartialFile) Write(data []byte) (int, error) {
+	n, err := p.file.Write(data)
+	p.size += int64(n)
+	return n, err
+}
+
+func (p *PartialFile) Reset() error {
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	file, err := p.fs.OpenFile(PartialPath(p.path), partialFlags|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	p.file = file
+	p.size = 0
+	return nil
+}
+
+func (p *PartialFile) Close() error {
+	return p.file.Close()
+}
+
+func (p *PartialFile) Commit() error {
+	if err := p.file.Sync(); err != nil {
+		p.file.Close()
+		return err
+	}
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	return p.fs.Rename(PartialPath(p.path), p.path)
+}
+
+func (p *PartialFile) Quarantine() (string, error) {
+	p.file.Close()
+	return moveToQuarantine(p.fs, PartialPath(p.path), p.path)
+}
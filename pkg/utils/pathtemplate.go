@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DefaultPathTemplate = "{rkey}_{handle}_{text}{index:_}.{ext}"
+	DefaultDateLayout   = "2006-01-02"
+	MaxSegmentBytes     = 255
+	MinFilenameBytes    = 32
+)
+
+type PathVars struct {
+	Kind          string
+	AccountDid    string
+	AccountHandle string
+	AuthorDid     string
+	AuthorHandle  string
+	Rkey          string
+	SourceRkey    string
+	Cid           string
+	Lang          string
+	Text          string
+	Ext           string
+	Index         int
+	Created       time.Time
+	SourceCreated time.Time
+	Archived      time.Time
+}
+
+type PathTemplate struct {
+	Sanitizer *Sanitizer
+	template  string
+	segments  [][]templatePart
+}
+
+type templatePart struct {
+	literal string
+	name    string
+	arg     string
+}
+
+type renderedPart struct {
+	value  string
+	shrink bool
+}
+
+var pathVariables = map[string]func(vars *PathVars, arg string) (string, error){
+	"kind":           stringVariable(func(v *PathVars) string { return v.Kind }),
+	"account_did":    stringVariable(func(v *PathVars) string { return v.AccountDid }),
+	"account_handle": stringVariable(func(v *PathVars) string { return v.AccountHandle }),
+	"author_did":     stringVariable(func(v *PathVars) string { return v.AuthorDid }),
+	"author_handle":  stringVariable(func(v *PathVars) string { return v.AuthorHandle }),
+	"handle":         stringVariable(func(v *PathVars) string { return v.AuthorHandle }),
+	"rkey":           stringVariable(func(v *PathVars) string { return v.Rkey }),
+	"source_rkey":    stringVariable(func(v *PathVars) string { return v.SourceRkey }),
+	"cid":            stringVariable(func(v *PathVars) string { return v.Cid }),
+	"lang":           stringVariable(func(v *PathVars) string { return v.Lang }),
+	"text":           stringVariable(func(v *PathVars) string { return v.Text }),
+	"ext":            stringVariable(func(v *PathVars) string { return v.Ext }),
+	"index":          indexVariable,
+	"created":        dateVariable(func(v *PathVars) time.Time { return v.Created }),
+	"source_created": dateVariable(func(v *PathVars) time.Time { return v.SourceCreated }),
+	"archived":       dateVariable(func(v *PathVars) time.Time { return v.Archived }),
+}
+
+func ParsePathTemplate(template string) (*PathTemplate, error) {
+	if template == "" {
+		return nil, fmt.Errorf("path template is empty")
+	}
+	if strings.HasPrefix(template, "/") || filepath.IsAbs(template) {
+		return nil, fmt.Errorf("path template must be relative: %s", template)
+	}
+	t := &PathTemplate{template: template}
+	var segment []templatePart
+	var literal strings.Builder
+	for i := 0; i < len(template); i++ {
+		switch c := template[i]; c {
+		case '{':
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed variable in path template: %s", template)
+			}
+			name, arg, _ := strings.Cut(template[i+1:i+end], ":")
+			render, ok := pathVariables[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown variable in path template: {%s}", name)
+			}
+			if _, err := render(&PathVars{}, arg); err != nil {
+				return nil, err
+			}
+			if literal.Len() > 0 {
+				segment = append(segment, templatePart{literal: literal.String()})
+				literal.Reset()
+			}
+			segment = append(segment, templatePart{name: name, arg: arg})
+			i += end
+		case '}':
+			return nil, fmt.Errorf("unexpected } in path template: %s", template)
+		case '/':
+			if literal.Len() > 0 {
+				segment = append(segment, templatePart{literal: literal.String()})
+				literal.Reset()
+			}
+			if len(segment) == 0 {
+				return nil, fmt.Errorf("empty directory in path template: %s", template)
+			}
+			t.segments = append(t.segments, segment)
+			segment = nil
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	if literal.Len() > 0 {
+		segment = append(segment, templatePart{literal: literal.String()})
+	}
+	if len(segment) == 0 {
+		return nil, fmt.Errorf("path template must end with a file name: %s", template)
+	}
+	t.segments = append(t.segments, segment)
+	for _, segment := range t.segments {
+		if len(segment) == 1 && (segment[0].literal == "." || segment[0].literal == "..") {
+			return nil, fmt.Errorf("path template must not contain . or ..: %s", template)
+		}
+	}
+	return t, nil
+}
+
+func MustParsePathTemplate(template string) *PathTemplate {
+	t, err := ParsePathTemplate(template)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *PathTemplate) sanitizer() *Sanitizer {
+	if t.Sanitizer == nil {
+		return defaultSanitizer
+	}
+	return t.Sanitizer
+}
+
+func (t *PathTemplate) String() string {
+	return t.template
+}
+
+func (t *PathTemplate) Render(directory string, vars *PathVars, maxBytes int) string {
+	return filepath.Join(directory, t.render(vars, maxBytes, t.sanitizer().pathBudget(directory)))
+}
+
+func (t *PathTemplate) render(vars *PathVars, maxBytes, budget int) string {
+	sanitizer := t.sanitizer()
+	var lines [][]renderedPart
+	for _, segment := range t.segments {
+		lines = append(lines, nil)
+		for _, part := range segment {
+			if part.name == "" {
+				lines[len(lines)-1] = append(lines[len(lines)-1], renderedPart{value: part.literal})
+				continue
+			}
+			value, _ := pathVariables[part.name](vars, part.arg)
+			if part.name == "created" || part.name == "source_created" || part.name == "archived" {
+				pieces := strings.Split(value, "/")
+				for n, piece := range pieces {
+					if n > 0 {
+						lines = append(lines, nil)
+					}
+					lines[len(lines)-1] = append(lines[len(lines)-1], renderedPart{value: sanitizer.Replace(piece)})
+				}
+				continue
+			}
+			lines[len(lines)-1] = append(lines[len(lines)-1], renderedPart{value: sanitizer.Replace(value), shrink: part.name == "text"})
+		}
+	}
+
+	var segments []string
+	used := 0
+	for n, line := range lines {
+		limit := maxBytes
+		if n == len(lines)-1 && budget > 0 {
+			limit = min(maxBytes, max(MinFilenameBytes, budget-used))
+		}
+		rendered := sanitizer.Segment(limitSegment(line, limit))
+		switch rendered {
+		case "":
+			continue
+		case ".", "..":
+			rendered = "_"
+		}
+		segments = append(segments, rendered)
+		used += len(rendered) + 1
+	}
+	return filepath.Join(segments...)
+}
+
+func limitSegment(parts []renderedPart, maxBytes int) string {
+	total := 0
+	for _, part := range parts {
+		total += len(part.value)
+	}
+	for i := len(parts) - 1; i >= 0 && total > maxBytes; i-- {
+		if !parts[i].shrink {
+			continue
+		}
+		before := len(parts[i].value)
+		parts[i].value = truncateBytes(parts[i].value, max(0, before-(total-maxBytes)))
+		total -= before - len(parts[i].value)
+	}
+	var joined strings.Builder
+	for _, part := range parts {
+		joined.WriteString(part.value)
+	}
+	segment := joined.String()
+	if len(segment) <= maxBytes {
+		return segment
+	}
+	ext := filepath.Ext(segment)
+	if len(ext) >= maxBytes {
+		ext = ""
+	}
+	return truncateBytes(strings.TrimSuffix(segment, ext), maxBytes-len(ext)) + ext
+}
+
+func truncateBytes(value string, maxBytes int) string {
+	if len(value) <= maxBytes {
+		return value
+	}
+	value = value[:maxBytes]
+	for len(value) > 0 && !utf8.ValidString(value) {
+		value = value[:len(value)-1]
+	}
+	return value
+}
+
+func stringVariable(get func(vars *PathVars) string) func(vars *PathVars, arg string) (string, error) {
+	return func(vars *PathVars, arg string) (string, error) {
+		if arg == "" {
+			return get(vars), nil
+		}
+		limit, err := strconv.Atoi(arg)
+		if err != nil || limit < 1 {
+			return "", fmt.Errorf("invalid byte limit in path template: %s", arg)
+		}
+		return truncateBytes(get(vars), limit), nil
+	}
+}
+
+func indexVariable(vars *PathVars, prefix string) (string, error) {
+	if vars.Index == 0 {
+		return "", nil
+	}
+	return prefix + strconv.Itoa(vars.Index), nil
+}
+
+func dateVariable(get func(vars *PathVars) time.Time) func(vars *PathVars, arg string) (string, error) {
+	return func(vars *PathVars, layout string) (string, error) {
+		if layout == "" {
+			layout = DefaultDateLayout
+		}
+		date := get(vars)
+		if date.IsZero() {
+			return "undated", nil
+		}
+		return date.UTC().Format(layout), nil
+	}
+}
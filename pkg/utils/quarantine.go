@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"path/filepath"
+)
+
+const (
+	QuarantineDirectory = "fw.quarantine"
+)
+
+func QuarantinePath(path string) string {
+	return filepath.Join(filepath.Dir(path), QuarantineDirectory, filepath.Base(path))
+}
+
+func QuarantineFile(fs FileSystem, path string) (string, error) {
+	return moveToQuarantine(fs, path, path)
+}
+
+func moveToQuarantine(fs FileSystem, src, path string) (string, error) {
+	dest := QuarantinePath(path)
+	if err := fs.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	exists, err := fileExists(fs, dest)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		if dest, err = freePath(fs, dest, "-%d"); err != nil {
+			return "", err
+		}
+	}
+	if err := fs.Rename(src, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
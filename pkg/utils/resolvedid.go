@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const (
+	DefaultPLCURL = "https://plc.directory"
+)
+
+type DIDResolver interface {
+	ResolveDID(ctx context.Context, did syntax.DID) (*identity.DIDDocument, error)
+}
+
+type DefaultDIDResolver struct {
+	PLCURL     string
+	HTTPClient *http.Client
+}
+
+func (d *DefaultDIDResolver) ResolveDID(ctx context.Context, did syntax.DID) (*identity.DIDDocument, error) {
+	switch did.Method() {
+	case "plc":
+		plcURL := d.PLCURL
+		if plcURL == "" {
+			plcURL = DefaultPLCURL
+		}
+		return d.fetchDocument(ctx, plcURL+"/"+did.String())
+	case "web":
+		hostname, err := url.PathUnescape(did.Identifier())
+		if err != nil {
+			return nil, fmt.Errorf("invalid did:web identifier: %w The DID: %s", err, did)
+		}
+		return d.fetchDocument(ctx, "https://"+hostname+"/.well-known/did.json")
+	default:
+		return nil, fmt.Errorf("DID method not supported: %s", did.Method())
+	}
+}
+
+func (d *DefaultDIDResolver) fetchDocument(ctx context.Context, docURL string) (*identity.DIDDocument, error) {
+	client := d.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching DID document: %w The URL: %s", err, docURL)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching DID document: status %d The URL: %s", res.StatusCode, docURL)
+	}
+
+	var doc identity.DIDDocument
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error decoding DID document: %w The URL: %s", err, docURL)
+	}
+	return &doc, nil
+}
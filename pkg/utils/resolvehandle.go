@@ -2,27 +2,128 @@ package utils
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
 
-	"github.com/bluesky-social/indigo/api/atproto"
-	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 )
 
+var ErrHandleNotFound = errors.New("handle could not be resolved")
+
 type HandleResolver interface {
-	IdentityResolveHandle(ctx context.Context, c *xrpc.Client, handle string) (*atproto.IdentityResolveHandle_Output, error)
+	ResolveHandle(ctx context.Context, handle syntax.Handle) (syntax.DID, error)
+}
+
+type DefaultHandleResolver struct {
+	DNSResolver *net.Resolver
+	HTTPClient  *http.Client
 }
 
-type DefaultHandleResolver struct{}
+func (d *DefaultHandleResolver) ResolveHandle(ctx context.Context, handle syntax.Handle) (syntax.DID, error) {
+	did, dnsErr := d.resolveDNS(ctx, handle)
+	if dnsErr == nil {
+		return did, nil
+	}
+	did, httpErr := d.resolveWellKnown(ctx, handle)
+	if httpErr == nil {
+		return did, nil
+	}
+	return "", fmt.Errorf("%w: %w, %w The handle: %s", ErrHandleNotFound, dnsErr, httpErr, handle)
+}
+
+func (d *DefaultHandleResolver) resolveDNS(ctx context.Context, handle syntax.Handle) (syntax.DID, error) {
+	resolver := d.DNSResolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	records, err := resolver.LookupTXT(ctx, "_atproto."+handle.String())
+	if err != nil {
+		return "", fmt.Errorf("DNS lookup failed: %w", err)
+	}
 
-func (d *DefaultHandleResolver) IdentityResolveHandle(ctx context.Context, c *xrpc.Client, handle string) (*atproto.IdentityResolveHandle_Output, error) {
-	return atproto.IdentityResolveHandle(ctx, c, handle)
+	var found syntax.DID
+	for _, record := range records {
+		value, ok := strings.CutPrefix(record, "did=")
+		if !ok {
+			continue
+		}
+		did, err := syntax.ParseDID(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Errorf("invalid DID in DNS record: %w", err)
+		}
+		if found != "" && found != did {
+			return "", fmt.Errorf("multiple DIDs in DNS records: %s, %s", found, did)
+		}
+		found = did
+	}
+	if found == "" {
+		return "", errors.New("no DID in DNS records")
+	}
+	return found, nil
 }
 
-func ResolveHandle(client HandleResolver, handle string) (*atproto.IdentityResolveHandle_Output, error) {
-	did, err := client.IdentityResolveHandle(context.Background(), &xrpc.Client{
-		Host: "https://bsky.social",
-	}, handle)
+func (d *DefaultHandleResolver) resolveWellKnown(ctx context.Context, handle syntax.Handle) (syntax.DID, error) {
+	client := d.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+handle.String()+"/.well-known/atproto-did", nil)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("well-known lookup failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("well-known lookup failed: status %d", res.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 2048))
+	if err != nil {
+		return "", fmt.Errorf("well-known lookup failed: %w", err)
+	}
+	did, err := syntax.ParseDID(strings.TrimSpace(string(body)))
+	if err != nil {
+		return "", fmt.Errorf("invalid DID in well-known response: %w", err)
 	}
 	return did, nil
 }
+
+func ResolveHandle(client HandleResolver, dids DIDResolver, handle string) (string, error) {
+	ctx := context.Background()
+	if did, err := syntax.ParseDID(handle); err == nil {
+		return did.String(), nil
+	}
+
+	parsed, err := syntax.ParseHandle(strings.TrimPrefix(handle, "@"))
+	if err != nil {
+		return "", err
+	}
+	parsed = parsed.Normalize()
+
+	did, err := client.ResolveHandle(ctx, parsed)
+	if err != nil {
+		return "", err
+	}
+
+	doc, err := dids.ResolveDID(ctx, did)
+	if err != nil {
+		return "", fmt.Errorf("error resolving DID document: %w The DID: %s", err, did)
+	}
+	if doc.DID != did {
+		return "", fmt.Errorf("DID document does not match the resolved DID The DID: %s", did)
+	}
+	ident := identity.ParseIdentity(doc)
+	declared, err := ident.DeclaredHandle()
+	if err != nil || declared.Normalize() != parsed {
+		return "", fmt.Errorf("handle is not declared in the DID document The handle: %s The DID: %s", parsed, did)
+	}
+	return did.String(), nil
+}
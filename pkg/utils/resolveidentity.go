@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const (
+	InvalidHandle = "handle.invalid"
+)
+
+type DefaultIdentityResolver struct {
+	Handles HandleResolver
+	DIDs    DIDResolver
+	PDS     *PDSCache
+}
+
+func (d *DefaultIdentityResolver) ResolveIdentity(ctx context.Context, did string) (string, error) {
+	if d.PDS != nil {
+		d.PDS.Purge(did)
+	}
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return "", err
+	}
+	doc, err := d.DIDs.ResolveDID(ctx, parsed)
+	if err != nil {
+		return "", fmt.Errorf("error resolving DID document: %w The DID: %s", err, did)
+	}
+	ident := identity.ParseIdentity(doc)
+	declared, err := ident.DeclaredHandle()
+	if err != nil {
+		return InvalidHandle, nil
+	}
+	declared = declared.Normalize()
+
+	resolved, err := d.Handles.ResolveHandle(ctx, declared)
+	if err != nil {
+		return "", fmt.Errorf("error resolving handle: %w The handle: %s", err, declared)
+	}
+	if resolved != parsed {
+		return InvalidHandle, nil
+	}
+	return declared.String(), nil
+}
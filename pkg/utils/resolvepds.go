@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+func resolvePDS(ctx context.Context, client DIDResolver, did string) (string, error) {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return "", err
+	}
+	doc, err := client.ResolveDID(ctx, parsed)
+	if err != nil {
+		return "", err
+	}
+	ident := identity.ParseIdentity(doc)
+	endpoint := ident.PDSEndpoint()
+	if endpoint == "" {
+		return "", fmt.Errorf("DID document has no atproto_pds service endpoint: %s", did)
+	}
+	return endpoint, nil
+}
+
+type pdsEntry struct {
+	endpoint string
+	expires  time.Time
+}
+
+type PDSCache struct {
+	client  DIDResolver
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]pdsEntry
+}
+
+func NewPDSCache(client DIDResolver, ttl time.Duration) *PDSCache {
+	return &PDSCache{
+		client:  client,
+		ttl:     ttl,
+		entries: map[string]pdsEntry{},
+	}
+}
+
+func (c *PDSCache) PDS(ctx context.Context, did string) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[did]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.endpoint, nil
+	}
+
+	endpoint, err := resolvePDS(ctx, c.client, did)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[did] = pdsEntry{endpoint: endpoint, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return endpoint, nil
+}
+
+func (c *PDSCache) Purge(did string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, did)
+}
@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type SanitizeProfile string
+
+const (
+	ProfilePosix    SanitizeProfile = "posix"
+	ProfileWindows  SanitizeProfile = "windows"
+	ProfilePortable SanitizeProfile = "portable"
+	ProfileASCII    SanitizeProfile = "ascii"
+)
+
+const (
+	PosixMaxPath   = 4096
+	WindowsMaxPath = 260
+)
+
+var SanitizeProfiles = []SanitizeProfile{ProfilePosix, ProfileWindows, ProfilePortable, ProfileASCII}
+
+var defaultSanitizer = NewSanitizer(DefaultSanitizeProfile())
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true,
+	"COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true,
+	"LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+type Sanitizer struct {
+	Profile      SanitizeProfile
+	StripEmoji   bool
+	MaxPathBytes int
+}
+
+func NewSanitizer(profile SanitizeProfile) *Sanitizer {
+	s := &Sanitizer{Profile: profile, MaxPathBytes: WindowsMaxPath}
+	if profile == ProfilePosix {
+		s.MaxPathBytes = PosixMaxPath
+	}
+	return s
+}
+
+func DefaultSanitizeProfile() SanitizeProfile {
+	if runtime.GOOS == "windows" {
+		return ProfileWindows
+	}
+	return ProfilePosix
+}
+
+func ParseSanitizeProfile(profile string) (SanitizeProfile, error) {
+	for _, known := range SanitizeProfiles {
+		if SanitizeProfile(profile) == known {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unknown sanitize profile: %s", profile)
+}
+
+func (s *Sanitizer) Replace(value string) string {
+	value = norm.NFC.String(value)
+	if s.Profile == ProfileASCII {
+		value = norm.NFKD.String(value)
+	}
+	var b strings.Builder
+	replaced := false
+	for _, r := range value {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteRune(' ')
+		case r == '/' || r == 0:
+		case s.StripEmoji && isEmoji(r):
+		case s.Profile != ProfilePosix && (r < 0x20 || r == 0x7f || strings.ContainsRune(`"\|:<>?*`, r)):
+		case s.Profile == ProfileASCII && unicode.Is(unicode.Mn, r):
+		case s.Profile == ProfileASCII && r > unicode.MaxASCII:
+			if !replaced {
+				b.WriteRune('_')
+			}
+			replaced = true
+			continue
+		default:
+			b.WriteRune(r)
+		}
+		replaced = false
+	}
+	return b.String()
+}
+
+func (s *Sanitizer) Segment(segment string) string {
+	if s.Profile == ProfilePosix {
+		return segment
+	}
+	segment = strings.TrimRight(segment, ". ")
+	if s.Profile == ProfilePortable || s.Profile == ProfileASCII {
+		segment = strings.TrimLeft(segment, ".- ")
+	}
+	stem, _, _ := strings.Cut(segment, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		segment = "_" + segment
+	}
+	return segment
+}
+
+func (s *Sanitizer) pathBudget(directory string) int {
+	if s.MaxPathBytes <= 0 {
+		return 0
+	}
+	if absolute, err := filepath.Abs(directory); err == nil {
+		directory = absolute
+	}
+	return s.MaxPathBytes - len(directory) - 1
+}
+
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF:
+	case r >= 0x2600 && r <= 0x27BF:
+	case r >= 0x2B00 && r <= 0x2BFF:
+	case r >= 0xFE00 && r <= 0xFE0F:
+	case r >= 0xE0020 && r <= 0xE007F:
+	case r == 0x200D || r == 0x20E3 || r == 0x2122 || r == 0x2139 || r == 0x3030 || r == 0x303D:
+	default:
+		return false
+	}
+	return true
+}
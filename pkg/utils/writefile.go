@@ -1,46 +1,208 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+const (
+	TempPrefix = ".fw-"
+	TempSuffix = ".tmp"
+)
+
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictSuffix    ConflictPolicy = "suffix"
+	ConflictVersion   ConflictPolicy = "version"
+)
+
+var ConflictPolicies = []ConflictPolicy{ConflictSkip, ConflictOverwrite, ConflictSuffix, ConflictVersion}
+
 type FileSystem interface {
 	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Readlink(name string) (string, error)
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Link(oldname, newname string) error
+	Symlink(oldname, newname string) error
+	ConflictPolicy() ConflictPolicy
 }
 
 type File interface {
+	Read(data []byte) (int, error)
 	Write(data []byte) (int, error)
+	Sync() error
 	Close() error
 }
 
-type DefaultFileSystem struct{}
+type DefaultFileSystem struct {
+	OnConflict ConflictPolicy
+}
 
 func (dfs *DefaultFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
 	return os.OpenFile(name, flag, perm)
 }
 
-type DefaultFile struct {
-	file *os.File
+func (dfs *DefaultFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (dfs *DefaultFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (dfs *DefaultFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (dfs *DefaultFileSystem) Readlink(name string) (string, error) {
+	return os.Readlink(name)
 }
 
-func (df *DefaultFile) Write(data []byte) (int, error) {
-	return df.file.Write(data)
+func (dfs *DefaultFileSystem) Remove(name string) error {
+	return os.Remove(name)
 }
 
-func (df *DefaultFile) Close() error {
-	return df.file.Close()
+func (dfs *DefaultFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
 }
 
-func WriteFile(fs FileSystem, filepath string, data *[]byte) error {
-	f, err := fs.OpenFile(filepath, os.O_CREATE|os.O_WRONLY, 0644)
+func (dfs *DefaultFileSystem) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (dfs *DefaultFileSystem) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (dfs *DefaultFileSystem) ConflictPolicy() ConflictPolicy {
+	if dfs.OnConflict == "" {
+		return ConflictOverwrite
+	}
+	return dfs.OnConflict
+}
+
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	for _, known := range ConflictPolicies {
+		if ConflictPolicy(policy) == known {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unknown conflict policy: %s", policy)
+}
+
+func WriteFile(fs FileSystem, path string, data *[]byte) (string, error) {
+	target, err := ResolveConflict(fs, path)
 	if err != nil {
+		return "", err
+	}
+	if target == "" {
+		return path, nil
+	}
+	if err := WriteFileAtomic(fs, target, *data); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+func MakeParents(fs FileSystem, root, path string) error {
+	parent := filepath.Dir(path)
+	if parent == filepath.Clean(root) {
+		return nil
+	}
+	if _, err := fs.Stat(root); err != nil {
 		return err
 	}
-	defer f.Close()
+	return fs.MkdirAll(parent, 0755)
+}
 
-	_, err = f.Write(*data)
+func ResolveConflict(fs FileSystem, path string) (string, error) {
+	policy := fs.ConflictPolicy()
+	if policy == ConflictOverwrite {
+		return path, nil
+	}
+	exists, err := fileExists(fs, path)
+	if err != nil || !exists {
+		return path, err
+	}
+	switch policy {
+	case ConflictSkip:
+		return "", nil
+	case ConflictSuffix:
+		return freePath(fs, path, "-%d")
+	case ConflictVersion:
+		version, err := freePath(fs, path, ".v%d")
+		if err != nil {
+			return "", err
+		}
+		if err := fs.Rename(path, version); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy: %s", policy)
+}
+
+func freePath(fs FileSystem, path, format string) (string, error) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := stem + fmt.Sprintf(format, i) + ext
+		exists, err := fileExists(fs, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
+
+func fileExists(fs FileSystem, path string) (bool, error) {
+	_, err := fs.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func TempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf("%s%08x%s", TempPrefix, rand.Uint32(), TempSuffix))
+}
+
+func WriteFileAtomic(fs FileSystem, path string, data []byte) error {
+	tmp := TempPath(path)
+	f, err := fs.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		fs.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		fs.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	if err := fs.Rename(tmp, path); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
 	return nil
 }
@@ -1,9 +1,18 @@
 package _tests
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"firehose/pkg/api"
+	"firehose/pkg/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,14 +20,16 @@ import (
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/cenkalti/backoff/v5"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
 
 type APITestSuite struct {
 	suite.Suite
-	originalBackoffOpts backoff.RetryOption
-	originalMaxRetries  backoff.RetryOption
+	originalNewBackOff func() backoff.BackOff
+	originalMaxRetries backoff.RetryOption
 }
 
 func TestAPITestSuite(t *testing.T) {
@@ -27,11 +38,12 @@ func TestAPITestSuite(t *testing.T) {
 
 type MockAPIClient struct {
 	mock.Mock
+	api.DefaultAPIClient
 }
 
-func (m *MockAPIClient) SyncGetBlob(ctx context.Context, client *xrpc.Client, cid, repo string) ([]byte, error) {
-	args := m.Called(ctx, client, cid, repo)
-	return args.Get(0).([]byte), args.Error(1)
+func (m *MockAPIClient) SyncGetBlobStream(ctx context.Context, client *xrpc.Client, cid, repo string, offset int64) (*api.BlobStream, error) {
+	args := m.Called(ctx, client, cid, repo, offset)
+	return args.Get(0).(*api.BlobStream), args.Error(1)
 }
 
 func (m *MockAPIClient) RepoGetRecord(ctx context.Context, client *xrpc.Client, token, collection, repo, rkey string) (*atproto.RepoGetRecord_Output, error) {
@@ -45,43 +57,32 @@ func (m *MockAPIClient) FeedGetPosts(ctx context.Context, client *xrpc.Client, u
 }
 
 func (suite *APITestSuite) SetupSuite() {
-	suite.originalBackoffOpts = api.BackoffOpts
+	suite.originalNewBackOff = api.NewBackOff
 	suite.originalMaxRetries = api.MaxRetries
 
-	api.BackoffOpts = backoff.WithBackOff(
-		&backoff.ExponentialBackOff{
+	api.NewBackOff = func() backoff.BackOff {
+		return &backoff.ExponentialBackOff{
 			InitialInterval:     1 * time.Millisecond,
 			RandomizationFactor: 0.0,
 			Multiplier:          1.0,
 			MaxInterval:         1 * time.Millisecond,
-		})
+		}
+	}
 	api.MaxRetries = backoff.WithMaxTries(5)
 }
 
 func (suite *APITestSuite) TearDownSuite() {
-	api.BackoffOpts = suite.originalBackoffOpts
+	api.NewBackOff = suite.originalNewBackOff
 	api.MaxRetries = suite.originalMaxRetries
 }
 
-func (suite *APITestSuite) TestGetBlob_Success() {
+func (suite *APITestSuite) TestDownloadBlob_Failure() {
 	mockClient := new(MockAPIClient)
-	mockClient.On("SyncGetBlob", mock.Anything, mock.Anything, "cid1", "repo1").Return([]byte("blob data"), nil)
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID([]byte("blob data")), "repo1", int64(0)).Return((*api.BlobStream)(nil), errors.New("mock error"))
 
-	res, err := api.GetBlob(mockClient, "repo1", "cid1")
-
-	suite.Assert().NoError(err)
-	suite.Assert().NotNil(res)
-	suite.Assert().Equal([]byte("blob data"), *res)
-}
-
-func (suite *APITestSuite) TestGetBlob_Failure() {
-	mockClient := new(MockAPIClient)
-	mockClient.On("SyncGetBlob", mock.Anything, mock.Anything, "cid1", "repo1").Return(([]byte)(nil), errors.New("mock error"))
-
-	res, err := api.GetBlob(mockClient, "repo1", "cid1")
+	err := api.DownloadBlob(context.Background(), mockClient, &utils.DefaultFileSystem{}, "repo1", blobCID([]byte("blob data")), filepath.Join(suite.T().TempDir(), "blob.jpeg"))
 
 	suite.Assert().Error(err)
-	suite.Assert().Nil(res)
 }
 
 func (suite *APITestSuite) TestGetPosts_Success() {
@@ -129,3 +130,302 @@ func (suite *APITestSuite) TestGetRecord_Failure() {
 	suite.Assert().Error(err)
 	mockClient.AssertExpectations(suite.T())
 }
+
+type stubHostResolver map[string]string
+
+func (s stubHostResolver) PDS(ctx context.Context, did string) (string, error) {
+	host, ok := s[did]
+	if !ok {
+		return "", errors.New("unknown did")
+	}
+	return host, nil
+}
+
+func (suite *APITestSuite) TestDownloadBlob_Uses_Repo_PDS() {
+	data := []byte("blob data")
+	mockClient := &MockAPIClient{DefaultAPIClient: api.DefaultAPIClient{Hosts: stubHostResolver{"repo1": "https://pds.example"}}}
+	mockClient.On(
+		"SyncGetBlobStream",
+		mock.Anything,
+		mock.MatchedBy(func(c *xrpc.Client) bool { return c.Host == "https://pds.example" }),
+		blobCID(data),
+		"repo1",
+		int64(0),
+	).Return(blobStream(data), nil)
+	path := filepath.Join(suite.T().TempDir(), "blob.jpeg")
+
+	err := api.DownloadBlob(context.Background(), mockClient, &utils.DefaultFileSystem{}, "repo1", blobCID(data), path)
+
+	suite.Require().NoError(err)
+	written, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(data, written)
+	mockClient.AssertExpectations(suite.T())
+}
+
+func (suite *APITestSuite) TestGetRecord_Failure_Unresolvable_PDS() {
+	mockClient := &MockAPIClient{DefaultAPIClient: api.DefaultAPIClient{Hosts: stubHostResolver{}}}
+
+	res, err := api.GetRecord(context.Background(), mockClient, "app.bsky.feed.like", "repo1", "rkey")
+
+	suite.Assert().Error(err)
+	suite.Assert().Nil(res)
+	mockClient.AssertNotCalled(suite.T(), "RepoGetRecord", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *APITestSuite) TestClassify() {
+	cases := map[api.ErrorClass]error{
+		api.ErrorNotFound:    &xrpc.Error{StatusCode: http.StatusBadRequest, Wrapped: &xrpc.XRPCError{ErrStr: "RecordNotFound"}},
+		api.ErrorRejected:    &xrpc.Error{StatusCode: http.StatusBadRequest, Wrapped: &xrpc.XRPCError{ErrStr: "InvalidRequest"}},
+		api.ErrorAuth:        &xrpc.Error{StatusCode: http.StatusUnauthorized},
+		api.ErrorRateLimited: &xrpc.Error{StatusCode: http.StatusTooManyRequests},
+		api.ErrorTransient:   &xrpc.Error{StatusCode: http.StatusServiceUnavailable},
+	}
+	for class, err := range cases {
+		suite.Assert().Equal(class, api.ClassOf(err), err.Error())
+	}
+	suite.Assert().Equal(api.ErrorNotFound, api.ClassOf(&xrpc.Error{StatusCode: http.StatusNotFound}))
+	suite.Assert().Equal(api.ErrorNotFound, api.ClassOf(&xrpc.Error{StatusCode: http.StatusBadRequest, Wrapped: &xrpc.XRPCError{ErrStr: "BlobNotFound"}}))
+	suite.Assert().Equal(api.ErrorRejected, api.ClassOf(&xrpc.Error{StatusCode: http.StatusRequestEntityTooLarge}))
+	suite.Assert().Equal(api.ErrorTransient, api.ClassOf(errors.New("connection reset")))
+	suite.Assert().Equal(api.ErrorClass(""), api.ClassOf(nil))
+}
+
+func (suite *APITestSuite) TestClassify_RateLimit_Reset() {
+	err := &xrpc.Error{
+		StatusCode: http.StatusTooManyRequests,
+		Ratelimit:  &xrpc.RatelimitInfo{Limit: 10, Remaining: 0, Reset: time.Now().Add(30 * time.Second)},
+	}
+
+	classified := api.Classify(err)
+
+	suite.Assert().Equal(api.ErrorRateLimited, classified.Class)
+	suite.Assert().InDelta(30*time.Second, classified.RetryAfter, float64(2*time.Second))
+	var retryAfter *backoff.RetryAfterError
+	suite.Assert().ErrorAs(classified, &retryAfter)
+}
+
+func (suite *APITestSuite) TestGetRecord_Permanent_Not_Retried() {
+	mockClient := new(MockAPIClient)
+	notFound := &xrpc.Error{StatusCode: http.StatusBadRequest, Wrapped: &xrpc.XRPCError{ErrStr: "RecordNotFound"}}
+	mockClient.On("RepoGetRecord", mock.Anything, mock.Anything, "", "app.bsky.feed.like", "repo1", "rkey").Return((*atproto.RepoGetRecord_Output)(nil), notFound)
+
+	res, err := api.GetRecord(context.Background(), mockClient, "app.bsky.feed.like", "repo1", "rkey")
+
+	suite.Assert().Nil(res)
+	suite.Assert().Equal(api.ErrorNotFound, api.ClassOf(err))
+	suite.Assert().ErrorIs(err, notFound)
+	suite.Assert().Equal(1, api.AttemptsOf(err))
+	mockClient.AssertNumberOfCalls(suite.T(), "RepoGetRecord", 1)
+}
+
+func (suite *APITestSuite) TestDownloadBlob_Transient_Retried() {
+	mockClient := new(MockAPIClient)
+	unavailable := &xrpc.Error{StatusCode: http.StatusServiceUnavailable}
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID([]byte("blob data")), "repo1", int64(0)).Return((*api.BlobStream)(nil), unavailable)
+
+	err := api.DownloadBlob(context.Background(), mockClient, &utils.DefaultFileSystem{}, "repo1", blobCID([]byte("blob data")), filepath.Join(suite.T().TempDir(), "blob.jpeg"))
+
+	suite.Assert().Equal(api.ErrorTransient, api.ClassOf(err))
+	suite.Assert().Equal(5, api.AttemptsOf(err))
+	mockClient.AssertNumberOfCalls(suite.T(), "SyncGetBlobStream", 5)
+}
+
+func (suite *APITestSuite) TestDownloadBlob_Honors_Retry_After() {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":"RateLimitExceeded","message":"slow down"}`))
+			return
+		}
+		w.Write([]byte("blob data"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(suite.T().TempDir(), "blob.jpeg")
+	started := time.Now()
+	err := api.DownloadBlob(context.Background(), &api.DefaultAPIClient{Hosts: api.StaticHost(server.URL)}, &utils.DefaultFileSystem{}, "did:plc:example", blobCID([]byte("blob data")), path)
+
+	suite.Require().NoError(err)
+	written, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal([]byte("blob data"), written)
+	suite.Assert().Equal(int32(2), requests.Load())
+	suite.Assert().GreaterOrEqual(time.Since(started), time.Second)
+}
+
+func (suite *APITestSuite) TestRateLimitTransport_Limits_Per_Host() {
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { requests.Add(1) })
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	client := &http.Client{Transport: api.NewRateLimitTransport(http.DefaultTransport, 20)}
+
+	started := time.Now()
+	for range 20 {
+		res, err := client.Get(second.URL)
+		suite.Require().NoError(err)
+		res.Body.Close()
+	}
+	suite.Assert().Less(time.Since(started), 500*time.Millisecond)
+
+	started = time.Now()
+	for range 25 {
+		res, err := client.Get(first.URL)
+		suite.Require().NoError(err)
+		res.Body.Close()
+	}
+	suite.Assert().GreaterOrEqual(time.Since(started), 200*time.Millisecond)
+	suite.Assert().Equal(int32(45), requests.Load())
+}
+
+func (suite *APITestSuite) TestNewHTTPClient_Proxy() {
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	client, err := api.NewHTTPClient(api.HTTPOptions{Proxy: proxy.URL})
+	suite.Require().NoError(err)
+	res, err := client.Get("http://pds.example/xrpc/com.atproto.sync.getBlob")
+	suite.Require().NoError(err)
+	defer res.Body.Close()
+
+	suite.Assert().Equal("http://pds.example/xrpc/com.atproto.sync.getBlob", proxied.Load())
+
+	_, err = api.NewHTTPClient(api.HTTPOptions{Proxy: "not a url"})
+	suite.Assert().Error(err)
+}
+
+func blobCID(data []byte) string {
+	hash, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, hash).String()
+}
+
+func blobStream(data []byte) *api.BlobStream {
+	return &api.BlobStream{Body: io.NopCloser(bytes.NewReader(data)), Length: int64(len(data))}
+}
+
+func serveBlob(suite *APITestSuite, data []byte, honorRange bool) (*api.DefaultAPIClient, *atomic.Value) {
+	var ranges atomic.Value
+	ranges.Store("")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Assert().Equal("/xrpc/com.atproto.sync.getBlob", r.URL.Path)
+		suite.Assert().Equal(blobCID(data), r.URL.Query().Get("cid"))
+		ranges.Store(r.Header.Get("Range"))
+		var offset int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil && honorRange {
+			if offset >= len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[offset:])
+			return
+		}
+		w.Write(data)
+	}))
+	suite.T().Cleanup(server.Close)
+	return &api.DefaultAPIClient{Hosts: api.StaticHost(server.URL)}, &ranges
+}
+
+func (suite *APITestSuite) TestDownloadBlob_Success() {
+	data := bytes.Repeat([]byte("blob data "), 1000)
+	client, _ := serveBlob(suite, data, true)
+	path := filepath.Join(suite.T().TempDir(), "blob.jpeg")
+
+	err := api.DownloadBlob(context.Background(), client, &utils.DefaultFileSystem{}, "did:plc:example", blobCID(data), path)
+
+	suite.Require().NoError(err)
+	written, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(data, written)
+	_, err = os.Stat(utils.PartialPath(path))
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+}
+
+func (suite *APITestSuite) TestDownloadBlob_Resumes_Partial() {
+	data := bytes.Repeat([]byte("blob data "), 1000)
+	client, ranges := serveBlob(suite, data, true)
+	path := filepath.Join(suite.T().TempDir(), "blob.jpeg")
+	suite.Require().NoError(os.WriteFile(utils.PartialPath(path), data[:4000], 0644))
+
+	err := api.DownloadBlob(context.Background(), client, &utils.DefaultFileSystem{}, "did:plc:example", blobCID(data), path)
+
+	suite.Require().NoError(err)
+	suite.Assert().Equal("bytes=4000-", ranges.Load())
+	written, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(data, written)
+}
+
+func (suite *APITestSuite) TestDownloadBlob_Commits_Complete_Partial() {
+	data := []byte("blob data")
+	client, _ := serveBlob(suite, data, true)
+	path := filepath.Join(suite.T().TempDir(), "blob.jpeg")
+	suite.Require().NoError(os.WriteFile(utils.PartialPath(path), data, 0644))
+
+	err := api.DownloadBlob(context.Background(), client, &utils.DefaultFileSystem{}, "did:plc:example", blobCID(data), path)
+
+	suite.Require().NoError(err)
+	written, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(data, written)
+}
+
+func (suite *APITestSuite) TestDownloadBlob_Restarts_Without_Range_Support() {
+	data := bytes.Repeat([]byte("blob data "), 1000)
+	client, ranges := serveBlob(suite, data, false)
+	path := filepath.Join(suite.T().TempDir(), "blob.jpeg")
+	suite.Require().NoError(os.WriteFile(utils.PartialPath(path), []byte("stale bytes"), 0644))
+
+	err := api.DownloadBlob(context.Background(), client, &utils.DefaultFileSystem{}, "did:plc:example", blobCID(data), path)
+
+	suite.Require().NoError(err)
+	suite.Assert().Equal("bytes=11-", ranges.Load())
+	written, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(data, written)
+}
+
+func (suite *APITestSuite) TestDownloadBlob_CID_Mismatch() {
+	expected := []byte("expected data")
+	mockClient := new(MockAPIClient)
+	for range 5 {
+		mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(expected), "did:plc:example", int64(0)).
+			Return(blobStream([]byte("corrupt data")), nil).Once()
+	}
+	path := filepath.Join(suite.T().TempDir(), "blob.jpeg")
+
+	err := api.DownloadBlob(context.Background(), mockClient, &utils.DefaultFileSystem{}, "did:plc:example", blobCID(expected), path)
+
+	suite.Assert().ErrorIs(err, api.ErrCIDMismatch)
+	mockClient.AssertNumberOfCalls(suite.T(), "SyncGetBlobStream", 5)
+	_, err = os.Stat(path)
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+	_, err = os.Stat(utils.PartialPath(path))
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+	quarantined, err := os.ReadFile(utils.QuarantinePath(path))
+	suite.Require().NoError(err)
+	suite.Assert().Equal([]byte("corrupt data"), quarantined)
+}
+
+func (suite *APITestSuite) TestVerifyBlob() {
+	data := []byte("blob data")
+
+	suite.Assert().NoError(api.VerifyBlob(bytes.NewReader(data), blobCID(data)))
+	suite.Assert().ErrorIs(api.VerifyBlob(bytes.NewReader([]byte("other data")), blobCID(data)), api.ErrCIDMismatch)
+	suite.Assert().Error(api.VerifyBlob(bytes.NewReader(data), "not a cid"))
+}
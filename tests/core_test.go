@@ -1,28 +1,46 @@
 package _tests
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"firehose/pkg/api"
 	"firehose/pkg/core"
 	"firehose/pkg/utils"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/cenkalti/backoff/v5"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/klauspost/compress/zstd"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
 
 type CoreTestSuite struct {
 	suite.Suite
-	originalBackoffOpts backoff.RetryOption
-	originalMaxRetries  backoff.RetryOption
+	originalNewBackOff func() backoff.BackOff
+	originalMaxRetries backoff.RetryOption
 }
 
 func TestCoreTestSuite(t *testing.T) {
@@ -44,41 +62,78 @@ func (m *MockCBORMarshaler) MarshalJSON() ([]byte, error) {
 	return args.Get(0).([]byte), args.Error(1)
 }
 
+type MockIdentityResolver struct {
+	mock.Mock
+}
+
+func (m *MockIdentityResolver) ResolveIdentity(ctx context.Context, did string) (string, error) {
+	args := m.Called(ctx, did)
+	return args.String(0), args.Error(1)
+}
+
 type MockDownloadClient struct {
 	mock.Mock
+	Layout  *utils.PathTemplate
+	AltText bool
 }
 
-func (m *MockDownloadClient) FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string) (string, error) {
-	args := m.Called(ctx, client, repo, path)
-	return args.Get(0).(string), args.Error(1)
+func (m *MockDownloadClient) FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string, record util.CBOR) (string, util.CBOR, error) {
+	args := m.Called(ctx, client, repo, path, record)
+	return args.Get(0).(string), record, args.Error(1)
 }
 
-func (m *MockDownloadClient) FetchPostDetails(ctx context.Context, client api.APIClient, atUri string) (*core.PostDetails, error) {
-	args := m.Called(ctx, client, atUri)
+func (m *MockDownloadClient) FetchPostDetails(ctx context.Context, client api.APIClient, atUri string, source *core.RepoOp) (*core.PostDetails, error) {
+	args := m.Called(ctx, client, atUri, source)
 	return args.Get(0).(*core.PostDetails), args.Error(1)
 }
 
-func (m *MockDownloadClient) DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, media *utils.Media, postDetails *core.PostDetails, directory string) error {
+func (m *MockDownloadClient) DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, media *utils.Media, postDetails *core.PostDetails, directory string) ([]string, error) {
 	args := m.Called(ctx, APIClient, FSClient, media, postDetails, directory)
-	return args.Error(0)
+	paths, _ := args.Get(0).([]string)
+	return paths, args.Error(1)
+}
+
+func (m *MockDownloadClient) PathLayout() *utils.PathTemplate {
+	return m.Layout
+}
+
+func (m *MockDownloadClient) AltTextSidecars() bool {
+	return m.AltText
+}
+
+type blobDownloadingClient struct {
+	*MockDownloadClient
+}
+
+func (c *blobDownloadingClient) DownloadBlobs(ctx context.Context, APIClient api.APIClient, FSClient utils.FileSystem, media *utils.Media, postDetails *core.PostDetails, directory string) ([]string, error) {
+	return core.DownloadBlobs(ctx, APIClient, FSClient, c.PathLayout(), media, postDetails, directory)
+}
+
+type recordFetchingClient struct {
+	*MockDownloadClient
+}
+
+func (c *recordFetchingClient) FetchPostIdentifier(ctx context.Context, client api.APIClient, repo, path string, record util.CBOR) (string, util.CBOR, error) {
+	return core.FetchPostIdentifier(ctx, client, repo, path, record)
 }
 
 func (suite *CoreTestSuite) SetupSuite() {
-	suite.originalBackoffOpts = api.BackoffOpts
+	suite.originalNewBackOff = api.NewBackOff
 	suite.originalMaxRetries = api.MaxRetries
 
-	api.BackoffOpts = backoff.WithBackOff(
-		&backoff.ExponentialBackOff{
+	api.NewBackOff = func() backoff.BackOff {
+		return &backoff.ExponentialBackOff{
 			InitialInterval:     1 * time.Millisecond,
 			RandomizationFactor: 0.0,
 			Multiplier:          1.0,
 			MaxInterval:         1 * time.Millisecond,
-		})
+		}
+	}
 	api.MaxRetries = backoff.WithMaxTries(5)
 }
 
 func (suite *CoreTestSuite) TearDownSuite() {
-	api.BackoffOpts = suite.originalBackoffOpts
+	api.NewBackOff = suite.originalNewBackOff
 	api.MaxRetries = suite.originalMaxRetries
 }
 
@@ -104,15 +159,17 @@ func (suite *CoreTestSuite) TestFetchPostIdentifier_Success() {
 		mock.Anything,
 		mock.Anything,
 		"",
-		"collection",
+		"app.bsky.feed.like",
 		"repo",
 		"rkey",
 	).Return(mockOutput, nil)
 
-	res, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "collection/rkey")
+	res, record, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "app.bsky.feed.like/rkey", nil)
 
 	suite.Assert().NoError(err)
 	suite.Assert().Equal("at://did:plc:vdnlidrx2n2nitqimqymzutr/app.bsky.feed.post/3lgmu7ro53226", res)
+	suite.Require().IsType(&bsky.FeedLike{}, record)
+	suite.Assert().Equal("2025-01-26T14:35:51.135Z", record.(*bsky.FeedLike).CreatedAt)
 
 	mockClient.AssertExpectations(suite.T())
 	mockMarshaler.AssertExpectations(suite.T())
@@ -126,12 +183,12 @@ func (suite *CoreTestSuite) TestFetchPostIdentifier_Failure_Record() {
 		mock.Anything,
 		mock.Anything,
 		"",
-		"collection",
+		"app.bsky.feed.like",
 		"repo",
 		"rkey",
 	).Return((*atproto.RepoGetRecord_Output)(nil), errors.New(""))
 
-	res, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "collection/rkey")
+	res, _, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "app.bsky.feed.like/rkey", nil)
 
 	suite.Assert().Error(err)
 	suite.Assert().Equal("", res)
@@ -159,12 +216,12 @@ func (suite *CoreTestSuite) TestFetchPostIdentifier_Failure_MarshalJSON() {
 		mock.Anything,
 		mock.Anything,
 		"",
-		"collection",
+		"app.bsky.feed.like",
 		"repo",
 		"rkey",
 	).Return(mockOutput, nil)
 
-	res, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "collection/rkey")
+	res, _, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "app.bsky.feed.like/rkey", nil)
 
 	suite.Assert().Error(err)
 	suite.Assert().Equal("", res)
@@ -173,6 +230,60 @@ func (suite *CoreTestSuite) TestFetchPostIdentifier_Failure_MarshalJSON() {
 	// mockMarshaler.AssertExpectations(suite.T())
 }
 
+func (suite *CoreTestSuite) TestFetchPostIdentifier_Success_Repost() {
+	mockClient := new(MockAPIClient)
+	mockMarshaler := new(MockCBORMarshaler)
+
+	mockJSON := []byte(`{"$type":"app.bsky.feed.repost","createdAt":"2025-01-26T14:35:51.135Z","subject":{"cid":"bafyreid34vpni5jvmiisfvtpjp6s54k2me5wtomfb6qcr63lqledr7tcxy","uri":"at://did:plc:vdnlidrx2n2nitqimqymzutr/app.bsky.feed.post/3lgmu7ro53226"}}`)
+	mockMarshaler.On("MarshalJSON").Return(mockJSON, nil)
+
+	mockOutput := &atproto.RepoGetRecord_Output{
+		Value: &util.LexiconTypeDecoder{Val: mockMarshaler},
+	}
+
+	mockClient.On(
+		"RepoGetRecord",
+		mock.Anything,
+		mock.Anything,
+		"",
+		"app.bsky.feed.repost",
+		"repo",
+		"rkey",
+	).Return(mockOutput, nil)
+
+	res, record, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "app.bsky.feed.repost/rkey", nil)
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal("at://did:plc:vdnlidrx2n2nitqimqymzutr/app.bsky.feed.post/3lgmu7ro53226", res)
+	suite.Require().IsType(&bsky.FeedRepost{}, record)
+	suite.Assert().Equal("2025-01-26T14:35:51.135Z", record.(*bsky.FeedRepost).CreatedAt)
+
+	mockClient.AssertExpectations(suite.T())
+	mockMarshaler.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestFetchPostIdentifier_Success_Post() {
+	mockClient := new(MockAPIClient)
+
+	res, _, err := core.FetchPostIdentifier(context.Background(), mockClient, "did:plc:example", "app.bsky.feed.post/rkey", nil)
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal("at://did:plc:example/app.bsky.feed.post/rkey", res)
+
+	mockClient.AssertNotCalled(suite.T(), "RepoGetRecord", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *CoreTestSuite) TestFetchPostIdentifier_Failure_Unsupported_Collection() {
+	mockClient := new(MockAPIClient)
+
+	res, _, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "app.bsky.feed.generator/rkey", nil)
+
+	suite.Assert().Error(err)
+	suite.Assert().Equal("", res)
+
+	mockClient.AssertNotCalled(suite.T(), "RepoGetRecord", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
 func (suite *CoreTestSuite) TestFetchPostDetails_Success() {
 	mockClient := new(MockAPIClient)
 	mockMarshaler := new(MockCBORMarshaler)
@@ -199,7 +310,7 @@ func (suite *CoreTestSuite) TestFetchPostDetails_Success() {
 		mock.Anything,
 	).Return(&mockRecord, nil)
 
-	postDetails, err := core.FetchPostDetails(context.Background(), mockClient, "at://example/repo/rkey")
+	postDetails, err := core.FetchPostDetails(context.Background(), mockClient, "at://example/repo/rkey", nil)
 
 	suite.Assert().NoError(err)
 	suite.Assert().NotNil(postDetails)
@@ -226,7 +337,7 @@ func (suite *CoreTestSuite) TestFetchPostDetails_Failure_No_Posts() {
 		mock.Anything,
 	).Return(&mockRecord, nil)
 
-	postDetails, err := core.FetchPostDetails(context.Background(), mockClient, "at://example/repo/rkey")
+	postDetails, err := core.FetchPostDetails(context.Background(), mockClient, "at://example/repo/rkey", nil)
 
 	suite.Assert().Error(err)
 	suite.Assert().Nil(postDetails)
@@ -234,90 +345,137 @@ func (suite *CoreTestSuite) TestFetchPostDetails_Failure_No_Posts() {
 	mockClient.AssertExpectations(suite.T())
 }
 
+func (suite *CoreTestSuite) TestFetchPostDetails_Local_Record() {
+	mockClient := new(MockAPIClient)
+	post := &bsky.FeedPost{Text: "just posted"}
+	op := &core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.post/rkey", Handle: "example.test", Cid: "bafypost", Record: post}
+
+	postDetails, err := core.FetchPostDetails(context.Background(), mockClient, "at://did:plc:example/app.bsky.feed.post/rkey", op)
+
+	suite.Require().NoError(err)
+	suite.Assert().Equal("example.test", postDetails.Handle)
+	suite.Assert().Equal("did:plc:example", postDetails.Repo)
+	suite.Assert().Equal("rkey", postDetails.Rkey)
+	suite.Assert().Equal("bafypost", postDetails.Cid)
+	suite.Assert().Same(post, postDetails.Response)
+	mockClient.AssertNotCalled(suite.T(), "FeedGetPosts", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *CoreTestSuite) TestFetchPostDetails_Local_Record_Without_Handle() {
+	mockClient := new(MockAPIClient)
+	post := &bsky.FeedPost{Text: "posted before the handle was known"}
+	op := &core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.post/rkey", Record: post}
+
+	postDetails, err := core.FetchPostDetails(context.Background(), mockClient, "at://did:plc:example/app.bsky.feed.post/rkey", op)
+
+	suite.Require().NoError(err)
+	suite.Assert().Equal("did:plc:example", postDetails.Handle)
+	suite.Assert().Equal("posted before the handle was known", postDetails.Text)
+	suite.Assert().Equal("rkey", postDetails.Rkey)
+	mockClient.AssertNotCalled(suite.T(), "FeedGetPosts", mock.Anything, mock.Anything, mock.Anything)
+}
+
 func (suite *CoreTestSuite) TestDownloadBlobs_Success_Images() {
 	mockClient := &MockAPIClient{}
-	mockFS := &MockFileSystem{}
-	mockFile := &MockFile{}
+	directory := suite.T().TempDir()
+	first, second := []byte("first image"), []byte("second image")
 	mockMedia := utils.Media{
-		ImageCid:  []string{"example_cid_1", "exmaple_cid_2"},
-		MediaType: "jpeg",
+		Items: []utils.MediaItem{
+			{Kind: utils.MediaImage, Cid: blobCID(first), MimeType: "image/jpeg", Index: 1},
+			{Kind: utils.MediaImage, Cid: blobCID(second), MimeType: "image/jpeg", Index: 2},
+		},
 	}
 	mockPostDetails := &core.PostDetails{
 		Handle: "example_handle",
 		Text:   "example_text",
 		Repo:   "did:plc:example",
 		Rkey:   "example_rkey",
-		Media: &utils.Media{
-			MediaType: "jpeg",
-		},
+		Media:  &mockMedia,
 	}
 
-	mockClient.On("SyncGetBlob", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return([]byte("blob data"), nil)
-	mockFile.On("Write", mock.Anything).Return(len([]byte("test data")), nil)
-	mockFile.On("Close").Return(nil)
-	mockFS.On("OpenFile", mock.Anything, mock.Anything, mock.Anything).Return(mockFile, nil)
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(first), "did:plc:example", int64(0)).Return(blobStream(first), nil)
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(second), "did:plc:example", int64(0)).Return(blobStream(second), nil)
 
-	err := core.DownloadBlobs(context.Background(), mockClient, mockFS, &mockMedia, mockPostDetails, "example_dir")
+	_, err := core.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, nil, &mockMedia, mockPostDetails, directory)
 
 	suite.Assert().Nil(err)
+	data, err := os.ReadFile(filepath.Join(directory, "example_rkey_example_handle_example_text_1.jpeg"))
+	suite.Require().NoError(err)
+	suite.Assert().Equal(first, data)
+	data, err = os.ReadFile(filepath.Join(directory, "example_rkey_example_handle_example_text_2.jpeg"))
+	suite.Require().NoError(err)
+	suite.Assert().Equal(second, data)
 
 	mockClient.AssertExpectations(suite.T())
-	mockFS.AssertExpectations(suite.T())
-	mockFile.AssertExpectations(suite.T())
 }
 
 func (suite *CoreTestSuite) TestDownloadBlobs_Success_Video() {
 	mockClient := &MockAPIClient{}
-	mockFS := &MockFileSystem{}
-	mockFile := &MockFile{}
+	directory := suite.T().TempDir()
+	video := []byte("video data")
 	mockMedia := utils.Media{
-		VideoCid:  "example_cid",
-		MediaType: "mp4",
+		Items: []utils.MediaItem{{Kind: utils.MediaVideo, Cid: blobCID(video), MimeType: "video/mp4"}},
 	}
 	mockPostDetails := &core.PostDetails{
 		Handle: "example_handle",
 		Text:   "example_text",
 		Repo:   "did:plc:example",
 		Rkey:   "example_rkey",
-		Media: &utils.Media{
-			MediaType: "mp4",
-		},
+		Media:  &mockMedia,
 	}
 
-	mockClient.On("SyncGetBlob", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return([]byte("blob data"), nil)
-	mockFile.On("Write", mock.Anything).Return(len([]byte("test data")), nil)
-	mockFile.On("Close").Return(nil)
-	mockFS.On("OpenFile", mock.Anything, mock.Anything, mock.Anything).Return(mockFile, nil)
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(video), "did:plc:example", int64(0)).Return(blobStream(video), nil)
 
-	err := core.DownloadBlobs(context.Background(), mockClient, mockFS, &mockMedia, mockPostDetails, "example_dir")
+	_, err := core.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, nil, &mockMedia, mockPostDetails, directory)
 
 	suite.Assert().Nil(err)
+	data, err := os.ReadFile(filepath.Join(directory, "example_rkey_example_handle_example_text.mp4"))
+	suite.Require().NoError(err)
+	suite.Assert().Equal(video, data)
+	_, err = os.Stat(utils.PartialPath(filepath.Join(directory, "example_rkey_example_handle_example_text.mp4")))
+	suite.Assert().True(errors.Is(err, os.ErrNotExist))
 
 	mockClient.AssertExpectations(suite.T())
-	mockFS.AssertExpectations(suite.T())
-	mockFile.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestDownloadBlobs_Skips_Existing() {
+	mockClient := &MockAPIClient{}
+	directory := suite.T().TempDir()
+	video := []byte("video data")
+	mockMedia := utils.Media{
+		Items: []utils.MediaItem{{Kind: utils.MediaVideo, Cid: blobCID(video), MimeType: "video/mp4"}},
+	}
+	mockPostDetails := &core.PostDetails{
+		Handle: "example_handle",
+		Text:   "example_text",
+		Repo:   "did:plc:example",
+		Rkey:   "example_rkey",
+		Media:  &mockMedia,
+	}
+	suite.Require().NoError(os.WriteFile(filepath.Join(directory, "example_rkey_example_handle_example_text.mp4"), video, 0644))
+
+	_, err := core.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{OnConflict: utils.ConflictSkip}, nil, &mockMedia, mockPostDetails, directory)
+
+	suite.Assert().NoError(err)
+	mockClient.AssertNotCalled(suite.T(), "SyncGetBlobStream")
 }
 
 func (suite *CoreTestSuite) TestDownloadBlobs_Failure_API() {
 	mockClient := &MockAPIClient{}
-	mockFS := &MockFileSystem{}
 	mockMedia := utils.Media{
-		VideoCid:  "example_cid",
-		MediaType: "mp4",
+		Items: []utils.MediaItem{{Kind: utils.MediaVideo, Cid: blobCID([]byte("video data")), MimeType: "video/mp4"}},
 	}
 	mockPostDetails := &core.PostDetails{
 		Handle: "example_handle",
 		Text:   "example_text",
 		Repo:   "did:plc:example",
 		Rkey:   "example_rkey",
-		Media: &utils.Media{
-			MediaType: "mp4",
-		},
+		Media:  &mockMedia,
 	}
 
-	mockClient.On("SyncGetBlob", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(([]byte)(nil), errors.New(""))
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return((*api.BlobStream)(nil), errors.New(""))
 
-	err := core.DownloadBlobs(context.Background(), mockClient, mockFS, &mockMedia, mockPostDetails, "example_dir")
+	_, err := core.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, nil, &mockMedia, mockPostDetails, suite.T().TempDir())
 
 	suite.Assert().Error(err)
 
@@ -328,62 +486,101 @@ func (suite *CoreTestSuite) TestDownloadBlobs_Failure_Write_File() {
 	mockClient := &MockAPIClient{}
 	mockFS := &MockFileSystem{}
 	mockFile := &MockFile{}
+	video := []byte("video data")
 	mockMedia := utils.Media{
-		VideoCid:  "example_cid",
-		MediaType: "mp4",
+		Items: []utils.MediaItem{{Kind: utils.MediaVideo, Cid: blobCID(video), MimeType: "video/mp4"}},
 	}
 	mockPostDetails := &core.PostDetails{
 		Handle: "example_handle",
 		Text:   "example_text",
 		Repo:   "did:plc:example",
 		Rkey:   "example_rkey",
-		Media: &utils.Media{
-			MediaType: "mp4",
-		},
+		Media:  &mockMedia,
 	}
 
-	mockClient.On("SyncGetBlob", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return([]byte("blob data"), nil)
+	for range 5 {
+		mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(video), "did:plc:example", int64(0)).Return(blobStream(video), nil).Once()
+	}
+	mockFS.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
 	mockFS.On("OpenFile", mock.Anything, mock.Anything, mock.Anything).Return(mockFile, nil)
 	mockFile.On("Write", mock.Anything).Return(0, errors.New(""))
 	mockFile.On("Close").Return(nil)
 
-	err := core.DownloadBlobs(context.Background(), mockClient, mockFS, &mockMedia, mockPostDetails, "example_dir")
+	_, err := core.DownloadBlobs(context.Background(), mockClient, mockFS, nil, &mockMedia, mockPostDetails, "example_dir")
 
 	suite.Assert().Error(err)
 
 	mockClient.AssertExpectations(suite.T())
 	mockFS.AssertExpectations(suite.T())
 	mockFile.AssertExpectations(suite.T())
+	mockFS.AssertNotCalled(suite.T(), "Rename", mock.Anything, mock.Anything)
 }
 
 func (suite *CoreTestSuite) TestDownloadBlobs_Failure_Open_File() {
 	mockClient := &MockAPIClient{}
 	mockFS := &MockFileSystem{}
-	mockFile := &MockFile{}
 	mockMedia := utils.Media{
-		VideoCid:  "example_cid",
-		MediaType: "mp4",
+		Items: []utils.MediaItem{{Kind: utils.MediaVideo, Cid: blobCID([]byte("video data")), MimeType: "video/mp4"}},
 	}
 	mockPostDetails := &core.PostDetails{
 		Handle: "example_handle",
 		Text:   "example_text",
 		Repo:   "did:plc:example",
 		Rkey:   "example_rkey",
-		Media: &utils.Media{
-			MediaType: "mp4",
-		},
+		Media:  &mockMedia,
 	}
 
-	mockClient.On("SyncGetBlob", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return([]byte("blob data"), nil)
-	mockFS.On("OpenFile", mock.Anything, mock.Anything, mock.Anything).Return(mockFile, errors.New(""))
+	mockFS.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+	mockFS.On("OpenFile", mock.Anything, mock.Anything, mock.Anything).Return((*MockFile)(nil), errors.New(""))
 
-	err := core.DownloadBlobs(context.Background(), mockClient, mockFS, &mockMedia, mockPostDetails, "example_dir")
+	_, err := core.DownloadBlobs(context.Background(), mockClient, mockFS, nil, &mockMedia, mockPostDetails, "example_dir")
 
 	suite.Assert().Error(err)
 
-	mockClient.AssertExpectations(suite.T())
 	mockFS.AssertExpectations(suite.T())
-	mockFile.AssertExpectations(suite.T())
+	mockClient.AssertNotCalled(suite.T(), "SyncGetBlobStream")
+}
+
+func (suite *CoreTestSuite) TestDownloadBlobs_Failure_Invalid_CID() {
+	mockClient := &MockAPIClient{}
+	mockFS := &MockFileSystem{}
+	mockMedia := utils.Media{
+		Items: []utils.MediaItem{{Kind: utils.MediaVideo, Cid: "example_cid", MimeType: "video/mp4"}},
+	}
+	mockPostDetails := &core.PostDetails{
+		Handle: "example_handle",
+		Text:   "example_text",
+		Repo:   "did:plc:example",
+		Rkey:   "example_rkey",
+		Media:  &mockMedia,
+	}
+
+	_, err := core.DownloadBlobs(context.Background(), mockClient, mockFS, nil, &mockMedia, mockPostDetails, suite.T().TempDir())
+
+	suite.Assert().Error(err)
+	suite.Assert().Equal(api.ErrorRejected, api.ClassOf(err))
+
+	mockClient.AssertNotCalled(suite.T(), "SyncGetBlobStream")
+}
+
+func (suite *CoreTestSuite) TestDownloadBlobs_Failure_Missing_Directory() {
+	mockClient := &MockAPIClient{}
+	mockMedia := utils.Media{
+		Items: []utils.MediaItem{{Kind: utils.MediaVideo, Cid: blobCID([]byte("video data")), MimeType: "video/mp4"}},
+	}
+	mockPostDetails := &core.PostDetails{
+		Handle: "example_handle",
+		Text:   "example_text",
+		Repo:   "did:plc:example",
+		Rkey:   "example_rkey",
+		Media:  &mockMedia,
+	}
+
+	_, err := core.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, nil, &mockMedia, mockPostDetails, filepath.Join(suite.T().TempDir(), "missing"))
+
+	suite.Assert().Error(err)
+
+	mockClient.AssertNotCalled(suite.T(), "SyncGetBlobStream")
 }
 
 func (suite *CoreTestSuite) TestDownloadPost_Success() {
@@ -396,23 +593,1723 @@ func (suite *CoreTestSuite) TestDownloadPost_Success() {
 		Text:   "example_text",
 		Repo:   "did:plc:example",
 		Rkey:   "example_rkey",
-		Media: &utils.Media{
-			MediaType: "mp4",
-		},
+		Media:  &utils.Media{},
 	}
 	mockAtUri := "example_aturi"
 
 	mockFile.On("Write", mock.Anything).Return(len([]byte("test data")), nil)
+	mockFile.On("Sync").Return(nil)
 	mockFile.On("Close").Return(nil)
 	mockFS.On("OpenFile", mock.Anything, mock.Anything, mock.Anything).Return(mockFile, nil)
+	mockFS.On("Rename", mock.Anything, mock.Anything).Return(nil)
 
-	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, mock.Anything, mock.Anything).Return(mockAtUri, nil)
-	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, mockAtUri).Return(mockPostDetails, nil)
-	mockClient.On("DownloadBlobs", mock.Anything, mockAPIClient, mockFS, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, mock.Anything, mock.Anything, mock.Anything).Return(mockAtUri, nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, mockAtUri, mock.Anything).Return(mockPostDetails, nil)
+	mockClient.On("DownloadBlobs", mock.Anything, mockAPIClient, mockFS, mock.Anything, mock.Anything, mock.Anything).Return(nil, nil)
 
-	core.DownloadPost(context.Background(), mockClient, mockAPIClient, mockFS, "repo_string", "repo_path", "dir")
+	core.ArchivePost(context.Background(), mockClient, mockAPIClient, mockFS, &core.RepoOp{Repo: "repo_string", Action: "create", Path: "repo_path"}, "dir")
 	mockFile.AssertExpectations(suite.T())
 	mockAPIClient.AssertExpectations(suite.T())
 	mockFS.AssertExpectations(suite.T())
 	mockClient.AssertExpectations(suite.T())
 }
+
+func (suite *CoreTestSuite) TestParseRepoPath_Success() {
+	res, err := core.ParseRepoPath("app.bsky.feed.like/3lgmu7ro53226")
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(core.LikeCollection, res.Collection)
+	suite.Assert().Equal("3lgmu7ro53226", res.Rkey.String())
+}
+
+func (suite *CoreTestSuite) TestParseRepoPath_Failure() {
+	res, err := core.ParseRepoPath("feed")
+
+	suite.Assert().Error(err)
+	suite.Assert().Nil(res)
+}
+
+func (suite *CoreTestSuite) TestSelectCollections_Success() {
+	res, err := core.SelectCollections([]string{"like", "post"})
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal([]syntax.NSID{core.LikeCollection, core.PostCollection}, res.Collections())
+}
+
+func (suite *CoreTestSuite) TestSelectCollections_Failure_Unknown() {
+	res, err := core.SelectCollections([]string{"like", "generator"})
+
+	suite.Assert().Error(err)
+	suite.Assert().Nil(res)
+}
+
+func (suite *CoreTestSuite) TestDefaultDownloadClient_Dispatches_Selected_Collections() {
+	registry := core.NewCollectionRegistry().Register(core.LikeCollection, func(ctx context.Context, client api.APIClient, repo, rkey string, record util.CBOR) (string, util.CBOR, error) {
+		return "at://selected/" + rkey, record, nil
+	})
+	dc := &core.DefaultDownloadClient{Collections: registry}
+
+	res, _, err := dc.FetchPostIdentifier(context.Background(), &MockAPIClient{}, "repo", "app.bsky.feed.like/rkey", nil)
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal("at://selected/rkey", res)
+	_, _, err = dc.FetchPostIdentifier(context.Background(), &MockAPIClient{}, "repo", "app.bsky.feed.post/rkey", nil)
+	suite.Assert().Error(err)
+}
+
+func (suite *CoreTestSuite) TestRepoCommit_Filters_Collections() {
+	mockAPIClient := &MockAPIClient{}
+	mockFS := &MockFileSystem{}
+	mockClient := &MockDownloadClient{}
+	registry, _ := core.SelectCollections([]string{"like"})
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/rkey", mock.Anything).Return("", errors.New(""))
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: "dir"}),
+		mockAPIClient,
+		mockFS,
+		mockClient,
+		registry,
+		queue,
+		2,
+	)
+	err := archiver.RepoCommit(&atproto.SyncSubscribeRepos_Commit{
+		Repo: "did:plc:example",
+		Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+			{Action: "create", Path: "app.bsky.feed.generator/rkey"},
+			{Action: "create", Path: "app.bsky.feed.threadgate/rkey"},
+			{Action: "create", Path: "app.bsky.feed.post/rkey"},
+			{Action: "create", Path: "app.bsky.feed.like/rkey"},
+		},
+	})
+	queue.Wait()
+
+	suite.Assert().NoError(err)
+	mockClient.AssertExpectations(suite.T())
+	mockClient.AssertNumberOfCalls(suite.T(), "FetchPostIdentifier", 1)
+}
+
+func makeCommitBlocks(suite *CoreTestSuite, record util.CBOR) (cid.Cid, []byte) {
+	buf := new(bytes.Buffer)
+	suite.Require().NoError(record.MarshalCBOR(buf))
+	data := buf.Bytes()
+
+	c, err := cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum(data)
+	suite.Require().NoError(err)
+
+	out := new(bytes.Buffer)
+	suite.Require().NoError(car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{c}, Version: 1}, out))
+	suite.Require().NoError(carutil.LdWrite(out, c.Bytes(), data))
+	return c, out.Bytes()
+}
+
+func (suite *CoreTestSuite) TestReadCommitBlocks_Success() {
+	like := &bsky.FeedLike{
+		LexiconTypeID: "app.bsky.feed.like",
+		CreatedAt:     "2025-01-26T14:35:51.135Z",
+		Subject: &atproto.RepoStrongRef{
+			Cid: "bafyreid34vpni5jvmiisfvtpjp6s54k2me5wtomfb6qcr63lqledr7tcxy",
+			Uri: "at://did:plc:vdnlidrx2n2nitqimqymzutr/app.bsky.feed.post/3lgmu7ro53226",
+		},
+	}
+	c, blocks := makeCommitBlocks(suite, like)
+
+	commitBlocks, err := core.ReadCommitBlocks(context.Background(), blocks)
+	suite.Require().NoError(err)
+
+	link := util.LexLink(c)
+	res, err := commitBlocks.OpRecord(context.Background(), &atproto.SyncSubscribeRepos_RepoOp{
+		Action: "create",
+		Path:   "app.bsky.feed.like/rkey",
+		Cid:    &link,
+	})
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(like, res)
+}
+
+func (suite *CoreTestSuite) TestReadCommitBlocks_Failure_Missing_Block() {
+	c, blocks := makeCommitBlocks(suite, &bsky.FeedLike{LexiconTypeID: "app.bsky.feed.like"})
+	other, err := cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum([]byte("other"))
+	suite.Require().NoError(err)
+	suite.Require().NotEqual(c, other)
+
+	commitBlocks, err := core.ReadCommitBlocks(context.Background(), blocks)
+	suite.Require().NoError(err)
+
+	res, err := commitBlocks.Record(context.Background(), other)
+
+	suite.Assert().Error(err)
+	suite.Assert().Nil(res)
+}
+
+func (suite *CoreTestSuite) TestFetchPostIdentifier_Success_Local_Record() {
+	mockClient := new(MockAPIClient)
+	repost := &bsky.FeedRepost{
+		LexiconTypeID: "app.bsky.feed.repost",
+		Subject: &atproto.RepoStrongRef{
+			Uri: "at://did:plc:vdnlidrx2n2nitqimqymzutr/app.bsky.feed.post/3lgmu7ro53226",
+		},
+	}
+
+	res, record, err := core.FetchPostIdentifier(context.Background(), mockClient, "repo", "app.bsky.feed.repost/rkey", repost)
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal("at://did:plc:vdnlidrx2n2nitqimqymzutr/app.bsky.feed.post/3lgmu7ro53226", res)
+	suite.Assert().Same(repost, record)
+	mockClient.AssertNotCalled(suite.T(), "RepoGetRecord", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *CoreTestSuite) TestRepoCommit_Decodes_Commit_Blocks() {
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	like := &bsky.FeedLike{
+		LexiconTypeID: "app.bsky.feed.like",
+		Subject:       &atproto.RepoStrongRef{Uri: "at://did:plc:other/app.bsky.feed.post/rkey"},
+	}
+	c, blocks := makeCommitBlocks(suite, like)
+	link := util.LexLink(c)
+
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/rkey", like).Return("", errors.New(""))
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: "dir"}),
+		mockAPIClient,
+		&MockFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		2,
+	)
+	err := archiver.RepoCommit(&atproto.SyncSubscribeRepos_Commit{
+		Repo:   "did:plc:example",
+		Blocks: blocks,
+		Ops: []*atproto.SyncSubscribeRepos_RepoOp{
+			{Action: "create", Path: "app.bsky.feed.like/rkey", Cid: &link},
+		},
+	})
+	queue.Wait()
+
+	suite.Assert().NoError(err)
+	mockClient.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestLoadCursor_Missing_File() {
+	cursor, err := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(int64(-1), cursor.Seq())
+}
+
+func (suite *CoreTestSuite) TestCursor_Flush_And_Load() {
+	path := filepath.Join(suite.T().TempDir(), core.CursorFilename)
+	cursor, err := core.LoadCursor(path)
+	suite.Require().NoError(err)
+
+	cursor.Set(42)
+	cursor.Set(41)
+	suite.Require().NoError(cursor.Flush())
+
+	res, err := core.LoadCursor(path)
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(int64(42), res.Seq())
+}
+
+func (suite *CoreTestSuite) TestLoadCursor_Failure_Corrupt() {
+	path := filepath.Join(suite.T().TempDir(), core.CursorFilename)
+	suite.Require().NoError(os.WriteFile(path, []byte("not json"), 0644))
+
+	res, err := core.LoadCursor(path)
+
+	suite.Assert().Error(err)
+	suite.Assert().Nil(res)
+}
+
+func (suite *CoreTestSuite) TestTrackCursor_Success() {
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	called := 0
+	handler := core.TrackCursor(cursor, func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+		called++
+		return nil
+	})
+
+	err := handler(context.Background(), &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{Seq: 100},
+	})
+	suite.Assert().NoError(err)
+
+	message := "cursor is older than the backfill window"
+	err = handler(context.Background(), &events.XRPCStreamEvent{
+		RepoInfo: &atproto.SyncSubscribeRepos_Info{Name: core.OutdatedCursor, Message: &message},
+	})
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(2, called)
+	suite.Assert().Equal(int64(100), cursor.Seq())
+}
+
+func (suite *CoreTestSuite) TestTrackCursor_Failure_Handler() {
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	handler := core.TrackCursor(cursor, func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+		return errors.New("")
+	})
+
+	err := handler(context.Background(), &events.XRPCStreamEvent{
+		RepoCommit: &atproto.SyncSubscribeRepos_Commit{Seq: 100},
+	})
+
+	suite.Assert().Error(err)
+	suite.Assert().Equal(int64(-1), cursor.Seq())
+}
+
+func serveFirehose(suite *CoreTestSuite, sessions ...func(con *websocket.Conn, r *http.Request)) (*httptest.Server, *atomic.Int32) {
+	upgrader := websocket.Upgrader{}
+	var count atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		con, err := upgrader.Upgrade(w, r, nil)
+		suite.Require().NoError(err)
+		defer con.Close()
+		i := int(count.Add(1)) - 1
+		if i < len(sessions) {
+			sessions[i](con, r)
+		}
+	}))
+	return server, &count
+}
+
+func writeIdentityEvent(suite *CoreTestSuite, con *websocket.Conn, seq int64) {
+	w, err := con.NextWriter(websocket.BinaryMessage)
+	suite.Require().NoError(err)
+	err = (&events.XRPCStreamEvent{
+		RepoIdentity: &atproto.SyncSubscribeRepos_Identity{Did: "did:plc:example", Seq: seq, Time: "2025-01-26T14:35:51.135Z"},
+	}).Serialize(w)
+	suite.Require().NoError(err)
+	suite.Require().NoError(w.Close())
+}
+
+func (suite *CoreTestSuite) TestFirehose_Reconnects_From_Cursor() {
+	var secondQuery atomic.Value
+	release := make(chan struct{})
+	server, count := serveFirehose(suite,
+		func(con *websocket.Conn, r *http.Request) {
+			writeIdentityEvent(suite, con, 10)
+		},
+		func(con *websocket.Conn, r *http.Request) {
+			secondQuery.Store(r.URL.RawQuery)
+			writeIdentityEvent(suite, con, 11)
+			<-release
+		},
+	)
+	defer server.Close()
+	defer close(release)
+
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	firehose := core.Firehose{
+		Hosts:  []string{"ws" + strings.TrimPrefix(server.URL, "http")},
+		Cursor: cursor,
+		Dialer: websocket.DefaultDialer,
+		Handler: core.TrackCursor(cursor, func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+			if xev.Sequence() == 11 {
+				cancel()
+			}
+			return nil
+		}),
+	}
+	err := firehose.Run(ctx)
+
+	suite.Assert().ErrorIs(err, context.Canceled)
+	suite.Assert().Equal(int32(2), count.Load())
+	suite.Assert().Equal("cursor=10", secondQuery.Load())
+	suite.Assert().Equal(int64(11), cursor.Seq())
+}
+
+func (suite *CoreTestSuite) TestFirehose_Watchdog_Forces_Reconnect() {
+	release := make(chan struct{})
+	server, count := serveFirehose(suite,
+		func(con *websocket.Conn, r *http.Request) {
+			<-release
+		},
+		func(con *websocket.Conn, r *http.Request) {
+			writeIdentityEvent(suite, con, 1)
+			<-release
+		},
+	)
+	defer server.Close()
+	defer close(release)
+
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	firehose := core.Firehose{
+		Hosts:       []string{"ws" + strings.TrimPrefix(server.URL, "http")},
+		Cursor:      cursor,
+		Dialer:      websocket.DefaultDialer,
+		IdleTimeout: 100 * time.Millisecond,
+		Handler: func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+			cancel()
+			return nil
+		},
+	}
+	err := firehose.Run(ctx)
+
+	suite.Assert().ErrorIs(err, context.Canceled)
+	suite.Assert().Equal(int32(2), count.Load())
+}
+
+func (suite *CoreTestSuite) TestFirehose_Watchdog_Waits_For_Blocked_Handler() {
+	release := make(chan struct{})
+	handled := make(chan struct{})
+	server, count := serveFirehose(suite,
+		func(con *websocket.Conn, r *http.Request) {
+			writeIdentityEvent(suite, con, 1)
+			<-handled
+			writeIdentityEvent(suite, con, 2)
+			<-release
+		},
+	)
+	defer server.Close()
+	defer close(release)
+
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	firehose := core.Firehose{
+		Hosts:       []string{"ws" + strings.TrimPrefix(server.URL, "http")},
+		Cursor:      cursor,
+		Dialer:      websocket.DefaultDialer,
+		IdleTimeout: 100 * time.Millisecond,
+		Handler: func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+			if xev.Sequence() == 1 {
+				time.Sleep(300 * time.Millisecond)
+				close(handled)
+				return nil
+			}
+			cancel()
+			return nil
+		},
+	}
+	err := firehose.Run(ctx)
+
+	suite.Assert().ErrorIs(err, context.Canceled)
+	suite.Assert().Equal(int32(1), count.Load())
+}
+
+func (suite *CoreTestSuite) TestFirehose_Falls_Back_To_Relay() {
+	release := make(chan struct{})
+	server, count := serveFirehose(suite,
+		func(con *websocket.Conn, r *http.Request) {
+			writeIdentityEvent(suite, con, 1)
+			<-release
+		},
+	)
+	defer server.Close()
+	defer close(release)
+
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailable.Close()
+
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relay := "ws" + strings.TrimPrefix(server.URL, "http")
+	firehose := core.Firehose{
+		Hosts:  []string{"ws" + strings.TrimPrefix(unavailable.URL, "http"), relay},
+		Cursor: cursor,
+		Dialer: websocket.DefaultDialer,
+		Handler: func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+			cancel()
+			return nil
+		},
+	}
+	err := firehose.Run(ctx)
+
+	suite.Assert().ErrorIs(err, context.Canceled)
+	suite.Assert().Equal(int32(1), count.Load())
+	suite.Assert().Equal(relay, firehose.Host())
+	suite.Assert().Equal(relay, cursor.Host())
+}
+
+func (suite *CoreTestSuite) TestFirehose_Idle_Sessions_Do_Not_Fall_Back() {
+	release := make(chan struct{})
+	idle := func(con *websocket.Conn, r *http.Request) {}
+	server, count := serveFirehose(suite,
+		idle, idle, idle, idle,
+		func(con *websocket.Conn, r *http.Request) {
+			con.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second))
+			writeIdentityEvent(suite, con, 1)
+			<-release
+		},
+	)
+	defer server.Close()
+	defer close(release)
+
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	primary := "ws" + strings.TrimPrefix(server.URL, "http")
+	firehose := core.Firehose{
+		Hosts:  []string{primary, "wss://bsky.network"},
+		Cursor: cursor,
+		Dialer: websocket.DefaultDialer,
+		Handler: func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+			cancel()
+			return nil
+		},
+	}
+	err := firehose.Run(ctx)
+
+	suite.Assert().ErrorIs(err, context.Canceled)
+	suite.Assert().Equal(int32(5), count.Load())
+	suite.Assert().Equal(primary, firehose.Host())
+}
+
+func (suite *CoreTestSuite) TestCursor_SwitchHost_Resets_Seq() {
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	cursor.SwitchHost("wss://pds.example")
+	cursor.Set(42)
+
+	suite.Assert().Equal(int64(42), cursor.SeqFor("wss://pds.example"))
+	suite.Assert().Equal(int64(-1), cursor.SeqFor("wss://bsky.network"))
+
+	cursor.SwitchHost("wss://bsky.network")
+
+	suite.Assert().Equal(int64(-1), cursor.Seq())
+	suite.Assert().Equal("wss://bsky.network", cursor.Host())
+}
+
+func (suite *CoreTestSuite) TestWebsocketHost() {
+	suite.Assert().Equal("wss://pds.example", core.WebsocketHost("https://pds.example/"))
+	suite.Assert().Equal("ws://localhost:2583", core.WebsocketHost("http://localhost:2583"))
+}
+
+const mockJetstreamLike = `{"did":"did:plc:example","time_us":1725911162329308,"kind":"commit","commit":{"rev":"3l3qo2vutsw2b","operation":"create","collection":"app.bsky.feed.like","rkey":"3l3qo2vuowo2b","record":{"$type":"app.bsky.feed.like","createdAt":"2024-09-09T19:46:02.102Z","subject":{"cid":"bafyreidc6sydkkbchcyg62v77wbhzvb2mvytlmsychqgwf2xojjtirmzj4","uri":"at://did:plc:wa7b35aakoll7hugkrjtf3xf/app.bsky.feed.post/3l3pte3p2e325"}},"cid":"bafyreidwaivazkwu67xztlmuobx35hs2lnfh3kolmgfmucldvhd3sgzcqi"}}`
+
+func (suite *CoreTestSuite) TestJetstream_Delivers_Events() {
+	var query atomic.Value
+	release := make(chan struct{})
+	server, _ := serveFirehose(suite,
+		func(con *websocket.Conn, r *http.Request) {
+			query.Store(r.URL.Query())
+			suite.Require().NoError(con.WriteMessage(websocket.TextMessage, []byte(mockJetstreamLike)))
+			<-release
+		},
+	)
+	defer server.Close()
+	defer close(release)
+
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var received *core.JetstreamEvent
+	jetstream := core.Jetstream{
+		Hosts:             []string{"ws" + strings.TrimPrefix(server.URL, "http")},
+		Cursor:            cursor,
+		Dialer:            websocket.DefaultDialer,
+		WantedDids:        []string{"did:plc:example"},
+		WantedCollections: []string{"app.bsky.feed.like", "app.bsky.feed.post"},
+		Handler: func(ctx context.Context, evt *core.JetstreamEvent) error {
+			received = evt
+			cancel()
+			return nil
+		},
+	}
+	err := jetstream.Run(ctx)
+
+	suite.Assert().ErrorIs(err, context.Canceled)
+	suite.Require().NotNil(received)
+	suite.Assert().Equal("app.bsky.feed.like", received.Commit.Collection)
+	suite.Assert().Equal(int64(1725911162329308), cursor.Seq())
+
+	values := query.Load().(url.Values)
+	suite.Assert().Equal([]string{"did:plc:example"}, values["wantedDids"])
+	suite.Assert().Equal([]string{"app.bsky.feed.like", "app.bsky.feed.post"}, values["wantedCollections"])
+	suite.Assert().Empty(values.Get("compress"))
+}
+
+func (suite *CoreTestSuite) TestJetstream_Decompresses_Events() {
+	contents := [][]byte{}
+	for i := 0; i < 1024; i++ {
+		contents = append(contents, []byte(strings.ReplaceAll(mockJetstreamLike, "3l3qo2vuowo2b", fmt.Sprintf("rkey%d", i))))
+	}
+	dictionary, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: contents,
+		History:  []byte(mockJetstreamLike),
+		Offsets:  [3]int{1, 4, 8},
+	})
+	suite.Require().NoError(err)
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dictionary))
+	suite.Require().NoError(err)
+	compressed := encoder.EncodeAll([]byte(mockJetstreamLike), nil)
+
+	var query atomic.Value
+	release := make(chan struct{})
+	server, _ := serveFirehose(suite,
+		func(con *websocket.Conn, r *http.Request) {
+			query.Store(r.URL.Query())
+			suite.Require().NoError(con.WriteMessage(websocket.BinaryMessage, compressed))
+			<-release
+		},
+	)
+	defer server.Close()
+	defer close(release)
+
+	cursor, _ := core.LoadCursor(filepath.Join(suite.T().TempDir(), core.CursorFilename))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var received *core.JetstreamEvent
+	jetstream := core.Jetstream{
+		Hosts:      []string{"ws" + strings.TrimPrefix(server.URL, "http")},
+		Cursor:     cursor,
+		Dialer:     websocket.DefaultDialer,
+		Dictionary: dictionary,
+		Handler: func(ctx context.Context, evt *core.JetstreamEvent) error {
+			received = evt
+			cancel()
+			return nil
+		},
+	}
+	err = jetstream.Run(ctx)
+
+	suite.Assert().ErrorIs(err, context.Canceled)
+	suite.Require().NotNil(received)
+	suite.Assert().Equal("did:plc:example", received.Did)
+	suite.Assert().Equal("true", query.Load().(url.Values).Get("compress"))
+}
+
+func (suite *CoreTestSuite) TestArchiver_JetstreamEvent() {
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+
+	var evt core.JetstreamEvent
+	suite.Require().NoError(json.Unmarshal([]byte(mockJetstreamLike), &evt))
+	op, err := evt.RepoOp()
+	suite.Require().NoError(err)
+	suite.Assert().Equal("bafyreidwaivazkwu67xztlmuobx35hs2lnfh3kolmgfmucldvhd3sgzcqi", op.Cid)
+
+	mockClient.On(
+		"FetchPostIdentifier",
+		mock.Anything,
+		mockAPIClient,
+		"did:plc:example",
+		"app.bsky.feed.like/3l3qo2vuowo2b",
+		mock.MatchedBy(func(record util.CBOR) bool {
+			like, ok := record.(*bsky.FeedLike)
+			return ok && like.Subject.Uri == "at://did:plc:wa7b35aakoll7hugkrjtf3xf/app.bsky.feed.post/3l3pte3p2e325"
+		}),
+	).Return("", errors.New(""))
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: "dir"}),
+		mockAPIClient,
+		&MockFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		2,
+	)
+	err = archiver.JetstreamEvent(context.Background(), &evt)
+	queue.Wait()
+
+	suite.Assert().NoError(err)
+	mockClient.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestArchiver_Routes_Accounts() {
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	first := &core.Account{Did: "did:plc:first", Handle: "first.example", Directory: "dir/first.example"}
+	second := &core.Account{Did: "did:plc:second", Handle: "second.example", Directory: "dir/second.example"}
+
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:first", "app.bsky.feed.like/rkey", mock.Anything).Return("", errors.New(""))
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:second", "app.bsky.feed.like/rkey", mock.Anything).Return("", errors.New(""))
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(first, second),
+		mockAPIClient,
+		&MockFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		2,
+	)
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:first", Action: "create", Path: "app.bsky.feed.like/rkey"})
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:first", Action: "create", Path: "app.bsky.graph.follow/rkey"})
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:second", Action: "create", Path: "app.bsky.feed.like/rkey"})
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:other", Action: "create", Path: "app.bsky.feed.like/rkey"})
+	queue.Wait()
+
+	suite.Assert().Equal(int64(2), first.Stats.Seen.Load())
+	suite.Assert().Equal(int64(1), first.Stats.Failed.Load())
+	suite.Assert().Equal(int64(1), second.Stats.Seen.Load())
+	suite.Assert().Equal(int64(1), second.Stats.Failed.Load())
+	suite.Assert().Equal([]string{"did:plc:first", "did:plc:second"}, archiver.Accounts().Dids())
+	mockClient.AssertNumberOfCalls(suite.T(), "FetchPostIdentifier", 2)
+	mockClient.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestArchiver_RepoIdentity_Updates_Handle() {
+	mockResolver := &MockIdentityResolver{}
+	mockFS := &MockFileSystem{}
+	mockFile := &MockFile{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	account := &core.Account{Did: "did:plc:example", Handle: "old.example", Directory: "dir"}
+
+	mockResolver.On("ResolveIdentity", mock.MatchedBy(func(ctx context.Context) bool {
+		_, ok := ctx.Deadline()
+		return ok
+	}), "did:plc:example").Return("new.example", nil)
+	mockFS.On("OpenFile", filepath.Join("dir", core.TimelineFilename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(0644)).Return(mockFile, nil)
+	mockFile.On("Write", mock.MatchedBy(func(data []byte) bool {
+		var entry core.TimelineEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return false
+		}
+		return entry.Kind == "identity" && entry.Seq == 7 && entry.Handle == "new.example" && entry.PreviousHandle == "old.example"
+	})).Return(0, nil)
+	mockFile.On("Close").Return(nil)
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(account),
+		&MockAPIClient{},
+		mockFS,
+		&MockDownloadClient{},
+		core.SupportedCollections,
+		queue,
+		2,
+	).FollowIdentity(mockResolver, false)
+	err := archiver.Callbacks().RepoIdentity(&atproto.SyncSubscribeRepos_Identity{Did: "did:plc:example", Seq: 7})
+	ignored := archiver.RepoIdentity(&atproto.SyncSubscribeRepos_Identity{Did: "did:plc:other", Seq: 8})
+
+	suite.Assert().NoError(err)
+	suite.Assert().NoError(ignored)
+	suite.Assert().Equal("new.example", account.CurrentHandle())
+	mockResolver.AssertNumberOfCalls(suite.T(), "ResolveIdentity", 1)
+	mockFS.AssertExpectations(suite.T())
+	mockFile.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestArchiver_Follows_Handle_Changes_In_Paths() {
+	root := suite.T().TempDir()
+	mockResolver := &MockIdentityResolver{}
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{Layout: utils.MustParsePathTemplate("{account_handle}_{rkey}.{ext}")}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	account := &core.Account{Did: "did:plc:example", Handle: "old.example", Root: root, Directory: core.AccountDirectory(root, "old.example")}
+	suite.Require().NoError(os.Mkdir(account.Directory, 0755))
+	atUri := "at://did:plc:author/app.bsky.feed.post/post"
+	mockResolver.On("ResolveIdentity", mock.Anything, "did:plc:example").Return("new.example", nil)
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", mock.Anything, mock.Anything).Return(atUri, nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, atUri, mock.Anything).Return(&core.PostDetails{Handle: "author.test", Repo: "did:plc:author", Rkey: "post", Response: &bsky.FeedPost{}}, nil)
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(account),
+		mockAPIClient,
+		&utils.DefaultFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		2,
+	).FollowIdentity(mockResolver, false)
+	suite.Require().NoError(archiver.RepoIdentity(&atproto.SyncSubscribeRepos_Identity{Did: "did:plc:example", Seq: 7}))
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/like"})
+	queue.Wait()
+
+	suite.Assert().Equal(filepath.Join(root, "new.example"), account.CurrentDirectory())
+	suite.Assert().FileExists(filepath.Join(root, "new.example", "new.example_post.json"))
+	suite.Assert().FileExists(filepath.Join(root, "new.example", core.TimelineFilename))
+}
+
+func (suite *CoreTestSuite) TestArchiver_RepoIdentity_Keeps_Handle_On_Failure() {
+	mockResolver := &MockIdentityResolver{}
+	mockFS := &MockFileSystem{}
+	mockFile := &MockFile{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	account := &core.Account{Did: "did:plc:example", Handle: "old.example", Directory: "dir"}
+
+	mockResolver.On("ResolveIdentity", mock.Anything, "did:plc:example").Return("", errors.New("unreachable"))
+	mockFS.On("OpenFile", mock.Anything, mock.Anything, mock.Anything).Return(mockFile, nil)
+	mockFile.On("Write", mock.MatchedBy(func(data []byte) bool {
+		return strings.Contains(string(data), `"error":"unreachable"`)
+	})).Return(0, nil)
+	mockFile.On("Close").Return(nil)
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(account),
+		&MockAPIClient{},
+		mockFS,
+		&MockDownloadClient{},
+		core.SupportedCollections,
+		queue,
+		2,
+	).FollowIdentity(mockResolver, false)
+	err := archiver.RepoIdentity(&atproto.SyncSubscribeRepos_Identity{Did: "did:plc:example", Seq: 7})
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal("old.example", account.CurrentHandle())
+	mockFile.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestAccount_SetHandle_Invalid_Uses_Did() {
+	root := suite.T().TempDir()
+	account := &core.Account{Did: "did:plc:example", Handle: "old.example", Root: root, Directory: core.AccountDirectory(root, "old.example")}
+
+	previous := account.SetHandle(utils.InvalidHandle)
+
+	suite.Assert().Equal("old.example", previous)
+	suite.Assert().Equal(core.AccountDirectory(root, "did:plc:example"), account.CurrentDirectory())
+}
+
+func (suite *CoreTestSuite) TestArchiver_RepoAccount_Pauses_Inactive() {
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	mockFS := &MockFileSystem{}
+	mockFile := &MockFile{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	account := &core.Account{Did: "did:plc:example", Handle: "example.test", Directory: "dir"}
+	status := "deactivated"
+
+	mockFS.On("OpenFile", filepath.Join("dir", core.TimelineFilename), mock.Anything, mock.Anything).Return(mockFile, nil)
+	mockFile.On("Write", mock.MatchedBy(func(data []byte) bool {
+		var entry core.TimelineEntry
+		return json.Unmarshal(data, &entry) == nil && entry.Kind == "account" && entry.Active != nil
+	})).Return(0, nil)
+	mockFile.On("Close").Return(nil)
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/resumed", mock.Anything).Return("", errors.New(""))
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(account),
+		mockAPIClient,
+		mockFS,
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		2,
+	).FollowIdentity(nil, true)
+
+	err := archiver.RepoAccount(&atproto.SyncSubscribeRepos_Account{Did: "did:plc:example", Active: false, Status: &status, Seq: 1})
+	suite.Require().NoError(err)
+	suite.Assert().False(account.Active())
+	suite.Assert().Equal("deactivated", account.Status())
+	suite.Assert().True(archiver.Paused(account))
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/paused"})
+
+	err = archiver.RepoAccount(&atproto.SyncSubscribeRepos_Account{Did: "did:plc:example", Active: true, Seq: 2})
+	suite.Require().NoError(err)
+	suite.Assert().False(archiver.Paused(account))
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/resumed"})
+	queue.Wait()
+
+	suite.Assert().Equal(int64(2), account.Stats.Seen.Load())
+	mockClient.AssertNumberOfCalls(suite.T(), "FetchPostIdentifier", 1)
+	mockFile.AssertNumberOfCalls(suite.T(), "Write", 2)
+}
+
+func (suite *CoreTestSuite) TestArchiver_Shutdown_Drains_In_Flight() {
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	started := make(chan struct{})
+
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/rkey", mock.Anything).
+		Run(func(mock.Arguments) {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+		}).
+		Return("", errors.New("deleted"))
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: "dir"}),
+		mockAPIClient,
+		&MockFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		2,
+	)
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/rkey"})
+	<-started
+	pending := archiver.Shutdown(time.Second)
+
+	suite.Assert().Empty(pending)
+	mockClient.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestArchiver_Shutdown_Returns_Cut_Off() {
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/slow", mock.Anything).
+		Run(func(args mock.Arguments) { <-args.Get(0).(context.Context).Done() }).
+		Return("", context.Canceled)
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: "dir"}),
+		mockAPIClient,
+		&MockFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		1,
+	)
+	slow := &core.RepoOp{Seq: 1, Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/slow"}
+	queued := &core.RepoOp{Seq: 2, Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/queued"}
+	archiver.Archive(context.Background(), slow)
+	archiver.Archive(context.Background(), queued)
+	time.Sleep(20 * time.Millisecond)
+	pending := archiver.Shutdown(50 * time.Millisecond)
+
+	suite.Assert().Equal([]*core.RepoOp{slow, queued}, pending)
+	mockClient.AssertNumberOfCalls(suite.T(), "FetchPostIdentifier", 1)
+}
+
+func (suite *CoreTestSuite) TestArchiver_Archive_Stops_Waiting_When_Stream_Cancelled() {
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 1)
+
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/slow", mock.Anything).
+		Run(func(args mock.Arguments) { <-args.Get(0).(context.Context).Done() }).
+		Return("", context.Canceled)
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: "dir"}),
+		mockAPIClient,
+		&MockFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		1,
+	)
+	archiver.Archive(context.Background(), &core.RepoOp{Seq: 1, Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/slow"})
+	time.Sleep(20 * time.Millisecond)
+	archiver.Archive(context.Background(), &core.RepoOp{Seq: 2, Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/queued"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		archiver.Archive(ctx, &core.RepoOp{Seq: 3, Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/blocked"})
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		suite.T().Fatal("Archive did not return after the stream was cancelled")
+	}
+	archiver.Shutdown(50 * time.Millisecond)
+}
+
+func (suite *CoreTestSuite) TestQueue_Journal_Survives_Restart() {
+	path := filepath.Join(suite.T().TempDir(), core.QueueFilename)
+	queue, err := core.OpenQueue(&utils.DefaultFileSystem{}, path, 10)
+	suite.Require().NoError(err)
+
+	first := &core.RepoOp{Seq: 1, Repo: "did:plc:example", Rev: "rev1", Action: "create", Path: "app.bsky.feed.like/one"}
+	second := &core.RepoOp{Seq: 2, Repo: "did:plc:example", Rev: "rev2", Action: "create", Path: "app.bsky.feed.post/two"}
+	suite.Require().NoError(queue.Push(context.Background(), first))
+	suite.Require().NoError(queue.Push(context.Background(), second))
+	suite.Assert().Equal(int64(2), queue.Depth())
+
+	job, ok := queue.Next(make(chan struct{}))
+	suite.Require().True(ok)
+	suite.Assert().Equal(first, job.Op)
+	suite.Assert().Equal(int64(1), queue.InFlight())
+	queue.Done(job)
+	suite.Require().NoError(queue.Close())
+
+	reopened, err := core.OpenQueue(&utils.DefaultFileSystem{}, path, 10)
+	suite.Require().NoError(err)
+	defer reopened.Close()
+
+	suite.Assert().Equal([]*core.RepoOp{second}, reopened.Pending())
+	suite.Assert().Equal(int64(1), reopened.Depth())
+	job, ok = reopened.Next(make(chan struct{}))
+	suite.Require().True(ok)
+	suite.Assert().Equal(second, job.Op)
+}
+
+func (suite *CoreTestSuite) TestQueue_Backpressure() {
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 1)
+	suite.Require().NoError(queue.Push(context.Background(), &core.RepoOp{Seq: 1}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := queue.Push(ctx, &core.RepoOp{Seq: 2})
+
+	suite.Assert().ErrorIs(err, context.DeadlineExceeded)
+	suite.Assert().Equal(int64(1), queue.Depth())
+
+	pushed := make(chan error)
+	go func() { pushed <- queue.Push(context.Background(), &core.RepoOp{Seq: 3}) }()
+	job, ok := queue.Next(make(chan struct{}))
+	suite.Require().True(ok)
+	queue.Done(job)
+
+	suite.Assert().NoError(<-pushed)
+	suite.Assert().Equal(int64(1), queue.Depth())
+}
+
+func (suite *CoreTestSuite) TestClassifyFailure() {
+	recordNotFound := &xrpc.Error{StatusCode: http.StatusBadRequest, Wrapped: &xrpc.XRPCError{ErrStr: "RecordNotFound"}}
+
+	suite.Assert().Equal(core.FailureDeleted, core.ClassifyFailure(fmt.Errorf("wrapped: %w", core.ErrSubjectDeleted)))
+	suite.Assert().Equal(core.FailureDeleted, core.ClassifyFailure(fmt.Errorf("wrapped: %w", recordNotFound)))
+	suite.Assert().Equal(core.FailureDeleted, core.ClassifyFailure(&xrpc.Error{StatusCode: http.StatusNotFound}))
+	suite.Assert().Equal(core.FailureRejected, core.ClassifyFailure(&xrpc.Error{StatusCode: http.StatusBadRequest, Wrapped: &xrpc.XRPCError{ErrStr: "InvalidRequest"}}))
+	suite.Assert().Equal(core.FailureTransient, core.ClassifyFailure(&xrpc.Error{StatusCode: http.StatusBadGateway}))
+	suite.Assert().Equal(core.FailureTransient, core.ClassifyFailure(errors.New("connection reset")))
+}
+
+func (suite *CoreTestSuite) TestDeadLetterStore_Merges_And_Replaces() {
+	path := filepath.Join(suite.T().TempDir(), core.DeadLetterFilename)
+	store := core.NewDeadLetterStore(&utils.DefaultFileSystem{}, path)
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	op := &core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.like/rkey"}
+
+	suite.Require().NoError(store.Add(core.NewDeadLetter(op, "dir", &api.Error{Class: api.ErrorTransient, Attempts: 5, Err: errors.New("timeout")}, first)))
+	suite.Require().NoError(store.Add(core.NewDeadLetter(op, "dir", core.ErrSubjectDeleted, first.Add(time.Hour))))
+	suite.Require().NoError(store.Add(core.NewDeadLetter(&core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.post/other"}, "dir", errors.New("timeout"), first)))
+
+	letters, err := store.Load()
+	suite.Require().NoError(err)
+	suite.Require().Len(letters, 2)
+	suite.Assert().Equal(core.FailureDeleted, letters[0].Class)
+	suite.Assert().Equal(6, letters[0].Attempts)
+	suite.Assert().Equal(first, letters[0].FirstFailed)
+	suite.Assert().Equal(first.Add(time.Hour), letters[0].LastFailed)
+	suite.Assert().Equal(core.FailureTransient, letters[1].Class)
+
+	suite.Require().NoError(store.Replace(letters[1:]))
+	letters, err = store.Load()
+	suite.Require().NoError(err)
+	suite.Assert().Len(letters, 1)
+
+	suite.Require().NoError(store.Replace(nil))
+	_, err = os.Stat(path)
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+}
+
+func (suite *CoreTestSuite) TestDeadLetterFilter_Matches() {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	letter := &core.DeadLetter{Class: core.FailureTransient, LastFailed: now.Add(-2 * time.Hour)}
+
+	suite.Assert().True((&core.DeadLetterFilter{}).Matches(letter, now))
+	suite.Assert().True((&core.DeadLetterFilter{Classes: []string{core.FailureTransient}}).Matches(letter, now))
+	suite.Assert().False((&core.DeadLetterFilter{Classes: []string{core.FailureDeleted}}).Matches(letter, now))
+	suite.Assert().True((&core.DeadLetterFilter{OlderThan: time.Hour}).Matches(letter, now))
+	suite.Assert().False((&core.DeadLetterFilter{OlderThan: 3 * time.Hour}).Matches(letter, now))
+	suite.Assert().True((&core.DeadLetterFilter{NewerThan: 3 * time.Hour}).Matches(letter, now))
+	suite.Assert().False((&core.DeadLetterFilter{NewerThan: time.Hour}).Matches(letter, now))
+}
+
+func (suite *CoreTestSuite) TestArchiver_Records_Dead_Letters() {
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	path := filepath.Join(suite.T().TempDir(), core.DeadLetterFilename)
+	store := core.NewDeadLetterStore(&utils.DefaultFileSystem{}, path)
+
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/rkey", mock.Anything).Return("at://did:plc:author/app.bsky.feed.post/post", nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, "at://did:plc:author/app.bsky.feed.post/post", mock.Anything).Return((*core.PostDetails)(nil), fmt.Errorf("missing: %w", core.ErrSubjectDeleted))
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: "dir"}),
+		mockAPIClient,
+		&MockFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		1,
+	).WithDeadLetters(store)
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/rkey"})
+	queue.Wait()
+
+	letters, err := store.Load()
+	suite.Require().NoError(err)
+	suite.Require().Len(letters, 1)
+	suite.Assert().Equal("at://did:plc:author/app.bsky.feed.post/post", letters[0].AtUri)
+	suite.Assert().Equal("app.bsky.feed.like/rkey", letters[0].Path)
+	suite.Assert().Equal("dir", letters[0].Directory)
+	suite.Assert().Equal(core.FailureDeleted, letters[0].Class)
+	suite.Assert().Equal(1, letters[0].Attempts)
+}
+
+func writePostMetadata(suite *CoreTestSuite, directory, rkey, handle string, post *bsky.FeedPost) string {
+	vars := &utils.PathVars{AuthorHandle: handle, Rkey: rkey, Text: post.Text, Ext: "json"}
+	path := utils.MustParsePathTemplate(utils.DefaultPathTemplate).Render(directory, vars, utils.MaxSegmentBytes)
+	data, err := json.MarshalIndent(post, "", "	")
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.WriteFile(path, data, 0644))
+	return path
+}
+
+func imagesPost(text string, blobs ...[]byte) *bsky.FeedPost {
+	images := []*bsky.EmbedImages_Image{}
+	for _, blob := range blobs {
+		parsed, _ := cid.Decode(blobCID(blob))
+		images = append(images, &bsky.EmbedImages_Image{Image: &util.LexBlob{Ref: util.LexLink(parsed), MimeType: "image/jpeg", Size: int64(len(blob))}})
+	}
+	return &bsky.FeedPost{Text: text, Embed: &bsky.FeedPost_Embed{EmbedImages: &bsky.EmbedImages{Images: images}}}
+}
+
+func (suite *CoreTestSuite) TestVerifyArchive() {
+	directory := suite.T().TempDir()
+	account := filepath.Join(directory, "did_plc_example")
+	suite.Require().NoError(os.Mkdir(account, 0755))
+	good, corrupt, missing := []byte("good image"), []byte("corrupt image"), []byte("missing image")
+	writePostMetadata(suite, account, "3kgood", "alice.test", imagesPost("hello world", good, corrupt))
+	writePostMetadata(suite, account, "3kmissing", "alice.test", imagesPost("gone", missing))
+	writePostMetadata(suite, account, "3ktext", "alice.test", &bsky.FeedPost{Text: "no media"})
+	goodPath := filepath.Join(account, "3kgood_alice.test_hello world_1.jpeg")
+	corruptPath := filepath.Join(account, "3kgood_alice.test_hello world_2.jpeg")
+	suite.Require().NoError(os.WriteFile(goodPath, good, 0644))
+	suite.Require().NoError(os.WriteFile(corruptPath, []byte("flipped bits"), 0644))
+
+	checks, err := core.VerifyArchive(&utils.DefaultFileSystem{}, nil, directory, false)
+
+	suite.Require().NoError(err)
+	statuses := map[string]string{}
+	for _, check := range checks {
+		statuses[filepath.Base(check.Path)] = check.Status
+	}
+	suite.Assert().Equal(map[string]string{
+		"3kgood_alice.test_hello world_1.jpeg": core.BlobOK,
+		"3kgood_alice.test_hello world_2.jpeg": core.BlobMismatch,
+		"3kmissing_alice.test_gone.jpeg":       core.BlobMissing,
+	}, statuses)
+	_, err = os.Stat(corruptPath)
+	suite.Assert().NoError(err)
+}
+
+func (suite *CoreTestSuite) TestVerifyArchive_Quarantines_Mismatches() {
+	directory := suite.T().TempDir()
+	blob := []byte("image")
+	writePostMetadata(suite, directory, "3kgood", "alice.test", imagesPost("hello", blob))
+	path := filepath.Join(directory, "3kgood_alice.test_hello.jpeg")
+	suite.Require().NoError(os.WriteFile(path, []byte("flipped bits"), 0644))
+
+	checks, err := core.VerifyArchive(&utils.DefaultFileSystem{}, nil, directory, true)
+
+	suite.Require().NoError(err)
+	suite.Require().Len(checks, 1)
+	suite.Assert().Equal(core.BlobMismatch, checks[0].Status)
+	suite.Assert().Equal(utils.QuarantinePath(path), checks[0].Quarantined)
+	_, err = os.Stat(path)
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+
+	checks, err = core.VerifyArchive(&utils.DefaultFileSystem{}, nil, directory, true)
+
+	suite.Require().NoError(err)
+	suite.Require().Len(checks, 1)
+	suite.Assert().Equal(core.BlobMissing, checks[0].Status)
+}
+
+func (suite *CoreTestSuite) TestBlobStore_Deduplicates_Downloads() {
+	directory := suite.T().TempDir()
+	store, err := core.OpenBlobStore(&utils.DefaultFileSystem{}, directory, core.LinkHard)
+	suite.Require().NoError(err)
+	image := []byte("shared image")
+	mockClient := &MockAPIClient{}
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(image), "did:plc:example", int64(0)).Return(blobStream(image), nil).Once()
+	downloadClient := &core.DefaultDownloadClient{Blobs: store}
+
+	for _, rkey := range []string{"3kfirst", "3ksecond"} {
+		postDetails := &core.PostDetails{
+			Handle: "alice.test",
+			Text:   "look",
+			Repo:   "did:plc:example",
+			Rkey:   rkey,
+			Media:  &utils.Media{Items: []utils.MediaItem{{Kind: utils.MediaImage, Cid: blobCID(image), MimeType: "image/jpeg"}}},
+		}
+		_, err := downloadClient.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, postDetails.Media, postDetails, directory)
+		suite.Require().NoError(err)
+	}
+
+	mockClient.AssertNumberOfCalls(suite.T(), "SyncGetBlobStream", 1)
+	stored, err := os.Stat(store.Path(blobCID(image), "jpeg"))
+	suite.Require().NoError(err)
+	for _, name := range []string{"3kfirst_alice.test_look.jpeg", "3ksecond_alice.test_look.jpeg"} {
+		linked, err := os.Stat(filepath.Join(directory, name))
+		suite.Require().NoError(err)
+		suite.Assert().True(os.SameFile(stored, linked), name)
+	}
+	suite.Assert().Len(store.References(blobCID(image)), 2)
+
+	reopened, err := core.OpenBlobStore(&utils.DefaultFileSystem{}, directory, core.LinkHard)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(store.References(blobCID(image)), reopened.References(blobCID(image)))
+}
+
+func (suite *CoreTestSuite) TestBlobStore_Symbolic_Links() {
+	directory := suite.T().TempDir()
+	account := filepath.Join(directory, "did_plc_example")
+	suite.Require().NoError(os.Mkdir(account, 0755))
+	store, err := core.OpenBlobStore(&utils.DefaultFileSystem{}, directory, core.LinkSymbolic)
+	suite.Require().NoError(err)
+	video := []byte("video data")
+	mockClient := &MockAPIClient{}
+	for range 5 {
+		mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(video), "did:plc:example", int64(0)).Return(blobStream(video), nil).Once()
+	}
+	postDetails := &core.PostDetails{
+		Handle: "alice.test",
+		Text:   "watch",
+		Repo:   "did:plc:example",
+		Rkey:   "3kvideo",
+		Media:  &utils.Media{Items: []utils.MediaItem{{Kind: utils.MediaVideo, Cid: blobCID(video), MimeType: "video/mp4"}}},
+	}
+
+	_, err = store.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, nil, postDetails.Media, postDetails, account)
+
+	suite.Require().NoError(err)
+	path := filepath.Join(account, "3kvideo_alice.test_watch.mp4")
+	target, err := os.Readlink(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(filepath.Join("..", core.BlobsDirectory, blobCID(video)+".mp4"), target)
+	data, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(video, data)
+
+	_, err = core.OpenBlobStore(&utils.DefaultFileSystem{}, directory, "copy")
+	suite.Assert().Error(err)
+}
+
+func readTombstones(suite *CoreTestSuite, directory string) []core.Tombstone {
+	data, err := os.ReadFile(filepath.Join(directory, core.TombstoneFilename))
+	suite.Require().NoError(err)
+	var tombstones []core.Tombstone
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var tombstone core.Tombstone
+		suite.Require().NoError(json.Unmarshal([]byte(line), &tombstone))
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones
+}
+
+func (suite *CoreTestSuite) TestArchiver_Tombstones_Deletes() {
+	directory := suite.T().TempDir()
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	index, err := core.OpenRecordIndex(&utils.DefaultFileSystem{}, directory)
+	suite.Require().NoError(err)
+	atUri := "at://did:plc:author/app.bsky.feed.post/post"
+	postDetails := &core.PostDetails{
+		Handle:   "author.test",
+		Text:     "hello",
+		Repo:     "did:plc:author",
+		Rkey:     "post",
+		Response: &bsky.FeedPost{Text: "hello"},
+	}
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", mock.Anything, mock.Anything).Return(atUri, nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, atUri, mock.Anything).Return(postDetails, nil)
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: directory}),
+		mockAPIClient,
+		&utils.DefaultFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		2,
+	).WithRecordIndex(index, core.DeleteRemove)
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/like"})
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.repost/repost"})
+	queue.Wait()
+	metadata := filepath.Join(directory, "post_author.test_hello.json")
+	entry, ok := index.Lookup("did:plc:example", "app.bsky.feed.like/like")
+	suite.Require().True(ok)
+	suite.Assert().Equal(atUri, entry.AtUri)
+	suite.Assert().Equal([]string{metadata}, entry.Files)
+
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Seq: 7, Action: "delete", Path: "app.bsky.feed.like/like"})
+	_, err = os.Stat(metadata)
+	suite.Assert().NoError(err)
+
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Seq: 8, Action: "delete", Path: "app.bsky.feed.repost/repost"})
+	_, err = os.Stat(metadata)
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Seq: 9, Action: "delete", Path: "app.bsky.feed.like/older"})
+
+	tombstones := readTombstones(suite, directory)
+	suite.Require().Len(tombstones, 3)
+	suite.Assert().Equal(atUri, tombstones[0].AtUri)
+	suite.Assert().Equal(int64(7), tombstones[0].Seq)
+	suite.Assert().Equal([]string{metadata}, tombstones[0].Shared)
+	suite.Assert().NotNil(tombstones[0].ArchivedAt)
+	suite.Assert().Empty(tombstones[0].Files)
+	suite.Assert().Equal([]string{metadata}, tombstones[1].Files)
+	suite.Assert().Equal(core.DeleteRemove, tombstones[1].Policy)
+	suite.Assert().Equal("app.bsky.feed.like/older", tombstones[2].Path)
+	suite.Assert().Empty(tombstones[2].AtUri)
+	suite.Assert().Nil(tombstones[2].ArchivedAt)
+	suite.Assert().Equal(int64(3), archiver.Accounts().All()[0].Stats.Deleted.Load())
+}
+
+func (suite *CoreTestSuite) TestArchiver_Orders_Deletes_After_Queued_Creates() {
+	directory := suite.T().TempDir()
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	queue, _ := core.OpenQueue(&utils.DefaultFileSystem{}, "", 10)
+	index, err := core.OpenRecordIndex(&utils.DefaultFileSystem{}, directory)
+	suite.Require().NoError(err)
+	atUri := "at://did:plc:author/app.bsky.feed.post/post"
+	postDetails := &core.PostDetails{
+		Handle:   "author.test",
+		Text:     "hello",
+		Repo:     "did:plc:author",
+		Rkey:     "post",
+		Response: &bsky.FeedPost{Text: "hello"},
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/like", mock.Anything).
+		Run(func(args mock.Arguments) {
+			close(started)
+			<-release
+		}).
+		Return(atUri, nil).Once()
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, atUri, mock.Anything).Return(postDetails, nil)
+
+	archiver := core.NewArchiver(
+		core.NewAccounts(&core.Account{Did: "did:plc:example", Directory: directory}),
+		mockAPIClient,
+		&utils.DefaultFileSystem{},
+		mockClient,
+		core.SupportedCollections,
+		queue,
+		1,
+	).WithRecordIndex(index, core.DeleteRemove)
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/like"})
+	<-started
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/queued"})
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Seq: 7, Action: "delete", Path: "app.bsky.feed.like/like"})
+	archiver.Archive(context.Background(), &core.RepoOp{Repo: "did:plc:example", Seq: 8, Action: "delete", Path: "app.bsky.feed.like/queued"})
+	close(release)
+	queue.Wait()
+
+	_, ok := index.Lookup("did:plc:example", "app.bsky.feed.like/like")
+	suite.Assert().False(ok)
+	_, err = os.Stat(filepath.Join(directory, "post_author.test_hello.json"))
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+	tombstones := readTombstones(suite, directory)
+	suite.Require().Len(tombstones, 2)
+	suite.Assert().Equal("app.bsky.feed.like/like", tombstones[0].Path)
+	suite.Assert().Equal(atUri, tombstones[0].AtUri)
+	suite.Assert().Equal(int64(7), tombstones[0].Seq)
+	suite.Assert().Equal("app.bsky.feed.like/queued", tombstones[1].Path)
+	suite.Assert().Empty(tombstones[1].AtUri)
+	mockClient.AssertNotCalled(suite.T(), "FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/queued", mock.Anything)
+	suite.Assert().Equal(int64(2), archiver.Accounts().All()[0].Stats.Deleted.Load())
+}
+
+func (suite *CoreTestSuite) TestRecordIndex_Move_Policy_Survives_Restart() {
+	directory := suite.T().TempDir()
+	file := filepath.Join(directory, "post_author.test_hello.json")
+	suite.Require().NoError(os.WriteFile(file, []byte("{}"), 0644))
+	index, err := core.OpenRecordIndex(&utils.DefaultFileSystem{}, directory)
+	suite.Require().NoError(err)
+	archived := &core.ArchivedPost{AtUri: "at://did:plc:author/app.bsky.feed.post/post", Files: []string{file}}
+	suite.Require().NoError(index.Add(core.NewIndexEntry("did:plc:example", "app.bsky.feed.like/like", archived, time.Now().UTC())))
+	suite.Require().NoError(index.Add(core.NewIndexEntry("did:plc:example", "app.bsky.feed.like/other", archived, time.Now().UTC())))
+	_, err = index.Delete(&core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.like/other"}, core.DeleteKeep, time.Now().UTC())
+	suite.Require().NoError(err)
+
+	reopened, err := core.OpenRecordIndex(&utils.DefaultFileSystem{}, directory)
+	suite.Require().NoError(err)
+	_, ok := reopened.Lookup("did:plc:example", "app.bsky.feed.like/other")
+	suite.Assert().False(ok)
+	tombstone, err := reopened.Delete(&core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.like/like"}, core.DeleteMove, time.Now().UTC())
+
+	suite.Require().NoError(err)
+	moved := filepath.Join(directory, core.DeletedDirectory, "post_author.test_hello.json")
+	suite.Assert().Equal([]string{moved}, tombstone.Files)
+	_, err = os.Stat(moved)
+	suite.Assert().NoError(err)
+	_, err = os.Stat(file)
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+
+	_, err = core.ParseDeletePolicy("shred")
+	suite.Assert().Error(err)
+}
+
+func (suite *CoreTestSuite) TestRecordIndex_Move_Policy_Keeps_Symbolic_Links() {
+	directory := suite.T().TempDir()
+	account := filepath.Join(directory, "did_plc_example")
+	suite.Require().NoError(os.Mkdir(account, 0755))
+	store, err := core.OpenBlobStore(&utils.DefaultFileSystem{}, directory, core.LinkSymbolic)
+	suite.Require().NoError(err)
+	image := []byte("image data")
+	mockClient := &MockAPIClient{}
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(image), "did:plc:example", int64(0)).Return(blobStream(image), nil).Once()
+	postDetails := &core.PostDetails{
+		Handle: "alice.test",
+		Text:   "look",
+		Repo:   "did:plc:example",
+		Rkey:   "3kimage",
+		Media:  &utils.Media{Items: []utils.MediaItem{{Kind: utils.MediaImage, Cid: blobCID(image), MimeType: "image/jpeg"}}},
+	}
+	files, err := store.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, nil, postDetails.Media, postDetails, account)
+	suite.Require().NoError(err)
+	index, err := core.OpenRecordIndex(&utils.DefaultFileSystem{}, account)
+	suite.Require().NoError(err)
+	archived := &core.ArchivedPost{AtUri: "at://did:plc:example/app.bsky.feed.post/3kimage", Files: files}
+	suite.Require().NoError(index.Add(core.NewIndexEntry("did:plc:example", "app.bsky.feed.post/3kimage", archived, time.Now().UTC())))
+
+	tombstone, err := index.Delete(&core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.post/3kimage"}, core.DeleteMove, time.Now().UTC())
+
+	suite.Require().NoError(err)
+	moved := filepath.Join(account, core.DeletedDirectory, "3kimage_alice.test_look.jpeg")
+	suite.Assert().Equal([]string{moved}, tombstone.Files)
+	target, err := os.Readlink(moved)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(filepath.Join("..", "..", core.BlobsDirectory, blobCID(image)+".jpeg"), target)
+	data, err := os.ReadFile(moved)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(image, data)
+	_, err = os.Lstat(files[0])
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+}
+
+func (suite *CoreTestSuite) TestRecordIndex_Remove_Policy_Releases_Blobs() {
+	directory := suite.T().TempDir()
+	store, err := core.OpenBlobStore(&utils.DefaultFileSystem{}, directory, core.LinkHard)
+	suite.Require().NoError(err)
+	index, err := core.OpenRecordIndex(&utils.DefaultFileSystem{}, directory)
+	suite.Require().NoError(err)
+	index.WithBlobStore(store)
+	image := []byte("shared image")
+	mockClient := &MockAPIClient{}
+	mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(image), "did:plc:example", int64(0)).Return(blobStream(image), nil).Once()
+	for _, rkey := range []string{"3kfirst", "3ksecond"} {
+		postDetails := &core.PostDetails{
+			Handle: "alice.test",
+			Text:   "look",
+			Repo:   "did:plc:example",
+			Rkey:   rkey,
+			Media:  &utils.Media{Items: []utils.MediaItem{{Kind: utils.MediaImage, Cid: blobCID(image), MimeType: "image/jpeg"}}},
+		}
+		files, err := store.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, nil, postDetails.Media, postDetails, directory)
+		suite.Require().NoError(err)
+		archived := &core.ArchivedPost{AtUri: "at://did:plc:example/app.bsky.feed.post/" + rkey, Files: files}
+		suite.Require().NoError(index.Add(core.NewIndexEntry("did:plc:example", "app.bsky.feed.post/"+rkey, archived, time.Now().UTC())))
+	}
+	stored := store.Path(blobCID(image), "jpeg")
+
+	_, err = index.Delete(&core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.post/3kfirst"}, core.DeleteRemove, time.Now().UTC())
+
+	suite.Require().NoError(err)
+	suite.Assert().Len(store.References(blobCID(image)), 1)
+	_, err = os.Stat(stored)
+	suite.Assert().NoError(err)
+
+	_, err = index.Delete(&core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.post/3ksecond"}, core.DeleteRemove, time.Now().UTC())
+
+	suite.Require().NoError(err)
+	suite.Assert().Empty(store.References(blobCID(image)))
+	_, err = os.Stat(stored)
+	suite.Assert().ErrorIs(err, os.ErrNotExist)
+	reopened, err := core.OpenBlobStore(&utils.DefaultFileSystem{}, directory, core.LinkHard)
+	suite.Require().NoError(err)
+	suite.Assert().Empty(reopened.References(blobCID(image)))
+}
+
+func (suite *CoreTestSuite) TestArchivePost_Writes_Envelope() {
+	directory := suite.T().TempDir()
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	atUri := "at://did:plc:author/app.bsky.feed.post/post"
+	like := &bsky.FeedLike{CreatedAt: "2025-01-26T14:35:51.135Z", Subject: &atproto.RepoStrongRef{Uri: atUri}}
+	op := &core.RepoOp{Seq: 42, Repo: "did:plc:example", Rev: "3lrev", Action: "create", Path: "app.bsky.feed.like/3llike", Record: like}
+	postDetails := &core.PostDetails{
+		Handle:   "author.test",
+		Text:     "hello",
+		Repo:     "did:plc:author",
+		Cid:      "bafypost",
+		Rkey:     "post",
+		Response: &bsky.FeedPost{Text: "hello", CreatedAt: "2025-01-25T10:00:00Z"},
+	}
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/3llike", like).Return(atUri, nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, atUri, mock.Anything).Return(postDetails, nil)
+
+	archived, err := core.ArchivePost(context.Background(), mockClient, mockAPIClient, &utils.DefaultFileSystem{}, op, directory)
+
+	suite.Require().NoError(err)
+	suite.Require().Len(archived.Files, 1)
+	envelope, err := core.LoadEnvelope(archived.Files[0])
+	suite.Require().NoError(err)
+	suite.Assert().Equal(core.EnvelopeVersion, envelope.Version)
+	suite.Assert().Equal("like", envelope.Reason)
+	suite.Assert().Equal(atUri, envelope.Uri)
+	suite.Assert().Equal("bafypost", envelope.Cid)
+	suite.Assert().Equal(core.EnvelopeAuthor{Did: "did:plc:author", Handle: "author.test"}, envelope.Author)
+	suite.Assert().Equal(core.EnvelopeSource{
+		Repo:       "did:plc:example",
+		Collection: "app.bsky.feed.like",
+		Rkey:       "3llike",
+		CreatedAt:  "2025-01-26T14:35:51.135Z",
+		Seq:        42,
+		Rev:        "3lrev",
+	}, envelope.Source)
+	suite.Require().NotNil(envelope.ArchivedAt)
+	suite.Assert().WithinDuration(time.Now(), *envelope.ArchivedAt, time.Minute)
+	suite.Assert().Equal("hello", envelope.Post.Text)
+}
+
+func (suite *CoreTestSuite) TestArchivePost_Source_Created_From_Fetched_Record() {
+	directory := suite.T().TempDir()
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{}
+	atUri := "at://did:plc:author/app.bsky.feed.post/post"
+	mockMarshaler := &MockCBORMarshaler{}
+	mockMarshaler.On("MarshalJSON").Return([]byte(`{"$type":"app.bsky.feed.like","createdAt":"2025-01-26T14:35:51.135Z","subject":{"cid":"bafypost","uri":"`+atUri+`"}}`), nil)
+	mockAPIClient.On("RepoGetRecord", mock.Anything, mock.Anything, "", "app.bsky.feed.like", "did:plc:example", "3llike").
+		Return(&atproto.RepoGetRecord_Output{Value: &util.LexiconTypeDecoder{Val: mockMarshaler}}, nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, atUri, mock.Anything).Return(&core.PostDetails{
+		Handle:   "author.test",
+		Text:     "hello",
+		Repo:     "did:plc:author",
+		Rkey:     "post",
+		Response: &bsky.FeedPost{Text: "hello", CreatedAt: "2025-01-25T10:00:00Z"},
+	}, nil)
+	op := &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/3llike"}
+
+	archived, err := core.ArchivePost(context.Background(), &recordFetchingClient{mockClient}, mockAPIClient, &utils.DefaultFileSystem{}, op, directory)
+
+	suite.Require().NoError(err)
+	envelope, err := core.LoadEnvelope(archived.Files[0])
+	suite.Require().NoError(err)
+	suite.Assert().Equal("2025-01-26T14:35:51.135Z", envelope.Source.CreatedAt)
+
+	post := &core.RepoOp{Repo: "did:plc:author", Action: "create", Path: "app.bsky.feed.post/post"}
+	archived, err = core.ArchivePost(context.Background(), &recordFetchingClient{mockClient}, mockAPIClient, &utils.DefaultFileSystem{}, post, suite.T().TempDir())
+
+	suite.Require().NoError(err)
+	envelope, err = core.LoadEnvelope(archived.Files[0])
+	suite.Require().NoError(err)
+	suite.Assert().Equal("2025-01-25T10:00:00Z", envelope.Source.CreatedAt)
+}
+
+func (suite *CoreTestSuite) TestArchivePost_Path_Template() {
+	layout := utils.MustParsePathTemplate("{kind}/{author_handle}/{created:2006/01}/{rkey}_{text:5}{index:_}.{ext}")
+	directory := suite.T().TempDir()
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{Layout: layout}
+	atUri := "at://did:plc:author/app.bsky.feed.post/post"
+	repost := &bsky.FeedRepost{CreatedAt: "2025-01-26T14:35:51.135Z", Subject: &atproto.RepoStrongRef{Uri: atUri}}
+	op := &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.repost/3lrepost", Record: repost}
+	first, second := []byte("first image"), []byte("second image")
+	post := imagesPost("hello world", first, second)
+	post.CreatedAt = "2025-01-25T10:00:00Z"
+	postDetails := &core.PostDetails{
+		Handle:   "author.test",
+		Text:     post.Text,
+		Repo:     "did:plc:author",
+		Rkey:     "post",
+		Response: post,
+		Media:    utils.ExtractMedia(post.Embed),
+	}
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.repost/3lrepost", repost).Return(atUri, nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, atUri, mock.Anything).Return(postDetails, nil)
+	nested := filepath.Join(directory, "repost", "author.test", "2025", "01")
+	mockClient.On("DownloadBlobs", mock.Anything, mockAPIClient, mock.Anything, postDetails.Media, mock.Anything, directory).
+		Return([]string{filepath.Join(nested, "post_hello_1.jpeg"), filepath.Join(nested, "post_hello_2.jpeg")}, nil)
+
+	archived, err := core.ArchivePost(context.Background(), mockClient, mockAPIClient, &utils.DefaultFileSystem{}, op, directory)
+
+	suite.Require().NoError(err)
+	suite.Assert().Equal([]string{
+		filepath.Join(nested, "post_hello_1.jpeg"),
+		filepath.Join(nested, "post_hello_2.jpeg"),
+		filepath.Join(nested, "post_hello.json"),
+	}, archived.Files)
+	suite.Require().FileExists(archived.Files[2])
+	suite.Require().NoError(os.WriteFile(archived.Files[0], first, 0644))
+	suite.Require().NoError(os.WriteFile(archived.Files[1], second, 0644))
+
+	checks, err := core.VerifyArchive(&utils.DefaultFileSystem{}, layout, directory, false)
+
+	suite.Require().NoError(err)
+	suite.Require().Len(checks, 2)
+	for _, check := range checks {
+		suite.Assert().Equal(core.BlobOK, check.Status, check.Path)
+	}
+}
+
+func (suite *CoreTestSuite) TestDownloadBlobs_Captions() {
+	mockClient := &MockAPIClient{}
+	directory := suite.T().TempDir()
+	video, english, german := []byte("video data"), []byte("WEBVTT\n\nhello"), []byte("WEBVTT\n\nhallo")
+	mockMedia := utils.Media{
+		Items: []utils.MediaItem{
+			{Kind: utils.MediaVideo, Cid: blobCID(video), MimeType: "video/mp4", Alt: "a cat"},
+			{Kind: utils.MediaCaption, Cid: blobCID(english), MimeType: "text/vtt", Lang: "en", Index: 1},
+			{Kind: utils.MediaCaption, Cid: blobCID(german), MimeType: "text/vtt", Lang: "de", Index: 2},
+		},
+	}
+	mockPostDetails := &core.PostDetails{
+		Handle: "example_handle",
+		Text:   "example_text",
+		Repo:   "did:plc:example",
+		Rkey:   "example_rkey",
+		Media:  &mockMedia,
+	}
+	for _, blob := range [][]byte{video, english, german} {
+		mockClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(blob), "did:plc:example", int64(0)).Return(blobStream(blob), nil)
+	}
+
+	_, err := core.DownloadBlobs(context.Background(), mockClient, &utils.DefaultFileSystem{}, nil, &mockMedia, mockPostDetails, directory)
+
+	suite.Require().NoError(err)
+	for name, expected := range map[string][]byte{
+		"example_rkey_example_handle_example_text.mp4":   video,
+		"example_rkey_example_handle_example_text_1.vtt": english,
+		"example_rkey_example_handle_example_text_2.vtt": german,
+	} {
+		data, err := os.ReadFile(filepath.Join(directory, name))
+		suite.Require().NoError(err)
+		suite.Assert().Equal(expected, data, name)
+	}
+	mockClient.AssertExpectations(suite.T())
+}
+
+func (suite *CoreTestSuite) TestArchivePost_Alt_Text() {
+	directory := suite.T().TempDir()
+	mockAPIClient := &MockAPIClient{}
+	mockClient := &MockDownloadClient{AltText: true}
+	atUri := "at://did:plc:author/app.bsky.feed.post/post"
+	like := &bsky.FeedLike{CreatedAt: "2025-01-26T14:35:51.135Z", Subject: &atproto.RepoStrongRef{Uri: atUri}}
+	op := &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/3llike", Record: like}
+	post := imagesPost("hello", []byte("described"), []byte("undescribed"))
+	post.Embed.EmbedImages.Images[0].Alt = "A red bicycle"
+	post.Embed.EmbedImages.Images[0].AspectRatio = &bsky.EmbedDefs_AspectRatio{Width: 4, Height: 3}
+	postDetails := &core.PostDetails{
+		Handle:   "author.test",
+		Text:     post.Text,
+		Repo:     "did:plc:author",
+		Rkey:     "post",
+		Response: post,
+		Media:    utils.ExtractMedia(post.Embed),
+	}
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/3llike", like).Return(atUri, nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, atUri, mock.Anything).Return(postDetails, nil)
+	mockClient.On("DownloadBlobs", mock.Anything, mockAPIClient, mock.Anything, postDetails.Media, mock.Anything, directory).
+		Return([]string{filepath.Join(directory, "post_author.test_hello_1.jpeg"), filepath.Join(directory, "post_author.test_hello_2.jpeg")}, nil)
+
+	archived, err := core.ArchivePost(context.Background(), mockClient, mockAPIClient, &utils.DefaultFileSystem{}, op, directory)
+
+	suite.Require().NoError(err)
+	sidecar := filepath.Join(directory, "post_author.test_hello_1.jpeg.txt")
+	suite.Assert().Contains(archived.Files, sidecar)
+	data, err := os.ReadFile(sidecar)
+	suite.Require().NoError(err)
+	suite.Assert().Equal("A red bicycle\n", string(data))
+	suite.Assert().NoFileExists(filepath.Join(directory, "post_author.test_hello_2.jpeg.txt"))
+
+	envelope, err := core.LoadEnvelope(archived.Files[len(archived.Files)-1])
+	suite.Require().NoError(err)
+	suite.Require().Len(envelope.Media, 2)
+	suite.Assert().Equal("A red bicycle", envelope.Media[0].Alt)
+	suite.Assert().Equal(&utils.AspectRatio{Width: 4, Height: 3}, envelope.Media[0].AspectRatio)
+	suite.Assert().Equal("post_author.test_hello_1.jpeg", envelope.Media[0].Path)
+	suite.Assert().Equal("", envelope.Media[1].Alt)
+	suite.Assert().Equal(2, envelope.Media[1].Index)
+}
+
+func (suite *CoreTestSuite) TestArchivePost_Records_Resolved_Paths() {
+	directory := suite.T().TempDir()
+	image := []byte("image data")
+	mockAPIClient := &MockAPIClient{}
+	mockAPIClient.On("SyncGetBlobStream", mock.Anything, mock.Anything, blobCID(image), "did:plc:author", int64(0)).Return(blobStream(image), nil)
+	mockClient := &MockDownloadClient{}
+	atUri := "at://did:plc:author/app.bsky.feed.post/post"
+	like := &bsky.FeedLike{CreatedAt: "2025-01-26T14:35:51.135Z", Subject: &atproto.RepoStrongRef{Uri: atUri}}
+	op := &core.RepoOp{Repo: "did:plc:example", Action: "create", Path: "app.bsky.feed.like/3llike", Record: like}
+	post := imagesPost("hello", image)
+	postDetails := &core.PostDetails{
+		Handle:   "author.test",
+		Text:     post.Text,
+		Repo:     "did:plc:author",
+		Rkey:     "post",
+		Response: post,
+		Media:    utils.ExtractMedia(post.Embed),
+	}
+	mockClient.On("FetchPostIdentifier", mock.Anything, mockAPIClient, "did:plc:example", "app.bsky.feed.like/3llike", like).Return(atUri, nil)
+	mockClient.On("FetchPostDetails", mock.Anything, mockAPIClient, atUri, mock.Anything).Return(postDetails, nil)
+	suite.Require().NoError(os.WriteFile(filepath.Join(directory, "post_author.test_hello.jpeg"), []byte("other"), 0644))
+	suite.Require().NoError(os.WriteFile(filepath.Join(directory, "post_author.test_hello.json"), []byte("{}"), 0644))
+
+	archived, err := core.ArchivePost(context.Background(), &blobDownloadingClient{mockClient}, mockAPIClient, &utils.DefaultFileSystem{OnConflict: utils.ConflictSuffix}, op, directory)
+
+	suite.Require().NoError(err)
+	suite.Assert().Equal([]string{
+		filepath.Join(directory, "post_author.test_hello-1.jpeg"),
+		filepath.Join(directory, "post_author.test_hello-1.json"),
+	}, archived.Files)
+	envelope, err := core.LoadEnvelope(archived.Files[1])
+	suite.Require().NoError(err)
+	suite.Require().Len(envelope.Media, 1)
+	suite.Assert().Equal("post_author.test_hello-1.jpeg", envelope.Media[0].Path)
+
+	checks, err := core.VerifyPost(&utils.DefaultFileSystem{}, nil, archived.Files[1], false)
+	suite.Require().NoError(err)
+	suite.Require().Len(checks, 1)
+	suite.Assert().Equal(core.BlobOK, checks[0].Status)
+	suite.Assert().Equal(archived.Files[0], checks[0].Path)
+}
+
+func (suite *CoreTestSuite) TestReadEnvelope_Versions() {
+	legacy, err := core.ReadEnvelope([]byte(`{"$type":"app.bsky.feed.post","text":"bare record","createdAt":"2025-01-25T10:00:00Z"}`))
+	suite.Require().NoError(err)
+	suite.Assert().Equal(0, legacy.Version)
+	suite.Assert().Equal("bare record", legacy.Post.Text)
+
+	_, err = core.ReadEnvelope([]byte(`{"version":99,"post":{}}`))
+	suite.Assert().ErrorContains(err, "unsupported metadata version")
+
+	_, err = core.ReadEnvelope([]byte(`not json`))
+	suite.Assert().Error(err)
+}
+
+func (suite *CoreTestSuite) TestDeadLetter_Keeps_Provenance() {
+	op := &core.RepoOp{Seq: 42, Repo: "did:plc:example", Rev: "3lrev", Action: "create", Path: "app.bsky.feed.repost/3lrepost"}
+
+	letter := core.NewDeadLetter(op, "dir", errors.New("boom"), time.Now().UTC())
+
+	suite.Assert().Equal(&core.RepoOp{Seq: 42, Repo: "did:plc:example", Rev: "3lrev", Action: "create", Path: "app.bsky.feed.repost/3lrepost"}, letter.RepoOp())
+}
+
+func (suite *CoreTestSuite) TestVerifyArchive_Reads_Envelopes() {
+	directory := suite.T().TempDir()
+	image := []byte("image")
+	post := imagesPost("hello", image)
+	postDetails := &core.PostDetails{Handle: "author.test", Text: "hello", Repo: "did:plc:author", Rkey: "3kpost", Response: post}
+	envelope := core.NewEnvelope(&core.RepoOp{Repo: "did:plc:example", Path: "app.bsky.feed.like/3llike"}, "at://did:plc:author/app.bsky.feed.post/3kpost", postDetails, time.Now().UTC())
+	data, err := json.Marshal(envelope)
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.WriteFile(filepath.Join(directory, "3kpost_author.test_hello.json"), data, 0644))
+	suite.Require().NoError(os.WriteFile(filepath.Join(directory, "3kpost_author.test_hello.jpeg"), image, 0644))
+
+	checks, err := core.VerifyArchive(&utils.DefaultFileSystem{}, nil, directory, false)
+
+	suite.Require().NoError(err)
+	suite.Require().Len(checks, 1)
+	suite.Assert().Equal(core.BlobOK, checks[0].Status)
+}
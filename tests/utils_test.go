@@ -6,12 +6,19 @@ import (
 	"errors"
 	"firehose/pkg/utils"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
-	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
-	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
@@ -38,12 +45,17 @@ type MockHandleResolver struct {
 	mock.Mock
 }
 
+type MockDIDResolver struct {
+	mock.Mock
+}
+
 type MockFile struct {
 	mock.Mock
 }
 
 type MockFileSystem struct {
 	mock.Mock
+	utils.DefaultFileSystem
 }
 
 func (m *MockFileSystem) OpenFile(name string, flag int, perm os.FileMode) (utils.File, error) {
@@ -51,19 +63,55 @@ func (m *MockFileSystem) OpenFile(name string, flag int, perm os.FileMode) (util
 	return args.Get(0).(utils.File), args.Error(1)
 }
 
+func (m *MockFileSystem) Rename(oldpath, newpath string) error {
+	args := m.Called(oldpath, newpath)
+	return args.Error(0)
+}
+
+func (m *MockFileSystem) Stat(name string) (os.FileInfo, error) {
+	args := m.Called(name)
+	info, _ := args.Get(0).(os.FileInfo)
+	return info, args.Error(1)
+}
+
+func (m *MockFileSystem) Remove(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *MockFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	args := m.Called(path, perm)
+	return args.Error(0)
+}
+
+func (m *MockFile) Read(data []byte) (int, error) {
+	args := m.Called(data)
+	return args.Get(0).(int), args.Error(1)
+}
+
 func (m *MockFile) Write(data []byte) (int, error) {
 	args := m.Called(data)
 	return args.Get(0).(int), args.Error(1)
 }
 
+func (m *MockFile) Sync() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
 func (m *MockFile) Close() error {
 	args := m.Called()
 	return args.Error(0)
 }
 
-func (m *MockHandleResolver) IdentityResolveHandle(ctx context.Context, c *xrpc.Client, handle string) (*atproto.IdentityResolveHandle_Output, error) {
-	args := m.Called(ctx, c, handle)
-	return args.Get(0).(*atproto.IdentityResolveHandle_Output), args.Error(1)
+func (m *MockHandleResolver) ResolveHandle(ctx context.Context, handle syntax.Handle) (syntax.DID, error) {
+	args := m.Called(ctx, handle)
+	return args.Get(0).(syntax.DID), args.Error(1)
+}
+
+func (m *MockDIDResolver) ResolveDID(ctx context.Context, did syntax.DID) (*identity.DIDDocument, error) {
+	args := m.Called(ctx, did)
+	return args.Get(0).(*identity.DIDDocument), args.Error(1)
 }
 
 func (suite *UtilsTestSuite) SetupSuite() {
@@ -77,7 +125,7 @@ func (suite *UtilsTestSuite) SetupSuite() {
 	var videoFeedPost *bsky.FeedPost_Embed
 	var imageFeedPost *bsky.FeedPost_Embed
 	var quoteImageFeedPost *bsky.FeedPost_Embed
-	err := json.Unmarshal([]byte(`{"$type":"app.bsky.embed.video","aspectRatio":{"height":1024,"width":576},"video":{"$type":"blob","ref":{"$link":"bafkreiawmtb3mxmfcwuf4w4cmun6gjgrj3ktv5zpsq2gwtos2nkjaenqqe"},"mimeType":"video/mp4","size":2934003}}`), &videoFeedPost)
+	err := json.Unmarshal([]byte(`{"$type":"app.bsky.embed.video","alt":"A cat knocking a glass off a table","aspectRatio":{"height":1024,"width":576},"captions":[{"lang":"en","file":{"$type":"blob","ref":{"$link":"bafkreidtiih5ybttav26bc4kbg23hasob4vj2loxijsame2jb3z2xlbl2a"},"mimeType":"text/vtt","size":7}}],"video":{"$type":"blob","ref":{"$link":"bafkreiawmtb3mxmfcwuf4w4cmun6gjgrj3ktv5zpsq2gwtos2nkjaenqqe"},"mimeType":"video/mp4","size":2934003}}`), &videoFeedPost)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -97,78 +145,218 @@ func (suite *UtilsTestSuite) SetupSuite() {
 	suite.videoFeedPost = videoFeedPost
 }
 
-func (suite *UtilsTestSuite) TestFilepath() {
-	res := utils.MakeFilepath(
-		suite.mockDirectory,
-		suite.mockRkey,
-		suite.mockHandle,
-		suite.mockText,
-		suite.mockMedia,
-		suite.mockI,
-		suite.mockMaxByte,
-	)
-	expected := fmt.Sprintf(
-		"%s/%s_%s_%s_%d.%s",
-		suite.mockDirectory,
-		suite.mockRkey,
-		suite.mockHandle,
-		suite.mockText,
-		suite.mockI,
-		suite.mockMedia,
-	)
-	suite.Assert().Equal(expected, res)
-}
-
-func (suite *UtilsTestSuite) TestFilenameLengthLimit_Exceed() {
-	char := "😊" // 4 bytes
-	var mockFilename string
-	var expected string
-	// 4 * 140 = 560 bytes
-	for i := 0; i < 140; i++ {
-		mockFilename += char
-		if i < 63 {
-			expected += char
+func (suite *UtilsTestSuite) TestPathTemplate_Default_Layout() {
+	template := utils.MustParsePathTemplate(utils.DefaultPathTemplate)
+	expected := map[int]string{
+		0:           fmt.Sprintf("%s/%s_%s_%s.%s", suite.mockDirectory, suite.mockRkey, suite.mockHandle, suite.mockText, suite.mockMedia),
+		suite.mockI: fmt.Sprintf("%s/%s_%s_%s_%d.%s", suite.mockDirectory, suite.mockRkey, suite.mockHandle, suite.mockText, suite.mockI, suite.mockMedia),
+	}
+	for i, expected := range expected {
+		vars := &utils.PathVars{
+			AuthorHandle: suite.mockHandle,
+			Rkey:         suite.mockRkey,
+			Text:         suite.mockText,
+			Ext:          suite.mockMedia,
+			Index:        i,
 		}
+
+		res := template.Render(suite.mockDirectory, vars, suite.mockMaxByte)
+
+		suite.Assert().Equal(expected, res)
 	}
-	res := utils.FilenameLengthLimit(mockFilename, 255)
+}
 
-	suite.Assert().LessOrEqual(len([]byte(res)), 255)
-	suite.Assert().Equal(expected, res)
+func (suite *UtilsTestSuite) TestPathTemplate_Nested_Layout() {
+	template, err := utils.ParsePathTemplate("{kind}/{author_handle}/{created:2006/01}/{rkey}_{text:5}{index:_}.{ext}")
+	suite.Require().NoError(err)
+	vars := &utils.PathVars{
+		Kind:         "like",
+		AuthorHandle: "example.com",
+		Rkey:         "3kabc",
+		Text:         "hello world",
+		Ext:          "jpeg",
+		Index:        2,
+		Created:      time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC),
+	}
+
+	res := template.Render("archive", vars, 255)
+
+	suite.Assert().Equal(filepath.Join("archive", "like", "example.com", "2024", "03", "3kabc_hello_2.jpeg"), res)
+	vars.Created = time.Time{}
+	suite.Assert().Equal(filepath.Join("archive", "like", "example.com", "undated", "3kabc_hello_2.jpeg"), template.Render("archive", vars, 255))
 }
 
-func (suite *UtilsTestSuite) TestFilenameLengthLimit_UnderLimit() {
-	mockFilename := "😊" // 4 bytes
-	res := utils.FilenameLengthLimit(mockFilename, 255)
+func (suite *UtilsTestSuite) TestPathTemplate_Truncates_Each_Segment() {
+	template := utils.MustParsePathTemplate("{author_handle}/{rkey}_{text}{index:_}.{ext}")
+	vars := &utils.PathVars{
+		AuthorHandle: strings.Repeat("h", 80),
+		Rkey:         "3kabc",
+		Text:         strings.Repeat("😊", 40),
+		Ext:          "jpeg",
+		Index:        1,
+	}
+
+	res := template.Render("", vars, 64)
 
-	suite.Assert().LessOrEqual(len(res), 255)
-	suite.Assert().Equal(mockFilename, res)
+	directory, filename := filepath.Split(res)
+	suite.Assert().Equal(strings.Repeat("h", 64)+string(filepath.Separator), directory)
+	suite.Assert().LessOrEqual(len(filename), 64)
+	suite.Assert().True(utf8.ValidString(filename))
+	suite.Assert().True(strings.HasPrefix(filename, "3kabc_😊"))
+	suite.Assert().True(strings.HasSuffix(filename, "_1.jpeg"))
+}
+
+func (suite *UtilsTestSuite) TestParsePathTemplate_Failure() {
+	for _, template := range []string{
+		"",
+		"/{rkey}.{ext}",
+		"{rkey}/../{text}.{ext}",
+		"{nope}.{ext}",
+		"{text:abc}.{ext}",
+		"{rkey}.{ext",
+		"{kind}//{rkey}.{ext}",
+		"{kind}/",
+	} {
+		_, err := utils.ParsePathTemplate(template)
+		suite.Assert().Error(err, template)
+	}
+}
+
+func (suite *UtilsTestSuite) TestSanitizer_Profiles() {
+	template := utils.MustParsePathTemplate("{author_handle}/{text}.{ext}")
+	vars := &utils.PathVars{AuthorHandle: "con", Text: "Cafe\u0301: what?\nyes... ", Ext: "json"}
+
+	cases := map[utils.SanitizeProfile]string{
+		utils.ProfilePosix:    filepath.Join("con", "Café: what? yes... .json"),
+		utils.ProfileWindows:  filepath.Join("_con", "Café what yes... .json"),
+		utils.ProfilePortable: filepath.Join("_con", "Café what yes... .json"),
+		utils.ProfileASCII:    filepath.Join("_con", "Cafe what yes... .json"),
+	}
+	for profile, expected := range cases {
+		template.Sanitizer = utils.NewSanitizer(profile)
+
+		res := template.Render("", vars, 255)
+
+		suite.Assert().Equal(expected, res, string(profile))
+	}
+}
+
+func (suite *UtilsTestSuite) TestSanitizer_Segment() {
+	windows := utils.NewSanitizer(utils.ProfileWindows)
+	portable := utils.NewSanitizer(utils.ProfilePortable)
+
+	suite.Assert().Equal("_LPT1.txt", windows.Segment("LPT1.txt"))
+	suite.Assert().Equal("_aux", windows.Segment("aux. "))
+	suite.Assert().Equal("console.txt", windows.Segment("console.txt"))
+	suite.Assert().Equal("..hidden", windows.Segment("..hidden"))
+	suite.Assert().Equal("hidden", portable.Segment("..hidden"))
+	suite.Assert().Equal("flag", portable.Segment("--flag"))
+	suite.Assert().Equal("con.", utils.NewSanitizer(utils.ProfilePosix).Segment("con."))
+}
+
+func (suite *UtilsTestSuite) TestSanitizer_Replace() {
+	sanitizer := utils.NewSanitizer(utils.ProfilePosix)
+	suite.Assert().Equal("so good 👍🏽 ❤️", sanitizer.Replace("so good 👍🏽 ❤️"))
+
+	sanitizer.StripEmoji = true
+	suite.Assert().Equal("so good  ", sanitizer.Replace("so good 👍🏽 ❤️"))
+	suite.Assert().Equal("family ", sanitizer.Replace("family 👨‍👩‍👧"))
+
+	ascii := utils.NewSanitizer(utils.ProfileASCII)
+	suite.Assert().Equal("naive _ _ fi", ascii.Replace("naïve 日本語 😊 ﬁ"))
+}
+
+func (suite *UtilsTestSuite) TestSanitizer_Path_Budget() {
+	directory := filepath.Join(suite.T().TempDir(), "archive")
+	template := utils.MustParsePathTemplate("{author_handle}/{rkey}_{text}{index:_}.{ext}")
+	template.Sanitizer = utils.NewSanitizer(utils.ProfileWindows)
+	vars := &utils.PathVars{AuthorHandle: "author.test", Rkey: "3kabc", Text: strings.Repeat("long text ", 30), Ext: "jpeg", Index: 1}
+
+	res := template.Render(directory, vars, utils.MaxSegmentBytes)
+
+	absolute, err := filepath.Abs(res)
+	suite.Require().NoError(err)
+	suite.Assert().LessOrEqual(len(absolute), utils.WindowsMaxPath)
+	suite.Assert().True(strings.HasSuffix(res, "_1.jpeg"))
+	suite.Assert().True(strings.HasPrefix(filepath.Base(res), "3kabc_long text"))
+
+	template.Sanitizer = utils.NewSanitizer(utils.ProfilePosix)
+	suite.Assert().Len(filepath.Base(template.Render(directory, vars, utils.MaxSegmentBytes)), 255)
+}
+
+func (suite *UtilsTestSuite) TestWriteFile_Full_Length_Name() {
+	path := filepath.Join(suite.T().TempDir(), strings.Repeat("a", 250)+".json")
+	data := []byte("{}")
+
+	res, err := utils.WriteFile(&utils.DefaultFileSystem{}, path, &data)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(path, res)
+
+	written, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(data, written)
+	suite.Assert().Less(len(filepath.Base(utils.PartialPath(path))), 32)
+	suite.Assert().Less(len(filepath.Base(utils.TempPath(path))), 32)
+}
+
+func (suite *UtilsTestSuite) TestParseSanitizeProfile() {
+	profile, err := utils.ParseSanitizeProfile("portable")
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(utils.ProfilePortable, profile)
+
+	_, err = utils.ParseSanitizeProfile("fat32")
+	suite.Assert().Error(err)
 }
 
 func (suite *UtilsTestSuite) TestExtractMedia_Image() {
 	res := utils.ExtractMedia(suite.imageFeedPost)
 	expected := utils.Media{
-		ImageCid:  []string{"bafkreie6rdowktrct6f4ehi5ti5vjpx7krfflekgrwjkyjgrav7tziegpe"},
-		MediaType: "jpeg",
+		Items: []utils.MediaItem{{
+			Kind:        utils.MediaImage,
+			Cid:         "bafkreie6rdowktrct6f4ehi5ti5vjpx7krfflekgrwjkyjgrav7tziegpe",
+			MimeType:    "image/jpeg",
+			AspectRatio: &utils.AspectRatio{Width: 1936, Height: 1936},
+		}},
 	}
 
 	suite.Assert().Equal(expected, *res)
+	suite.Assert().Equal("jpeg", res.Items[0].Ext())
 }
 
 func (suite *UtilsTestSuite) TestExtractMedia_Video() {
 	res := utils.ExtractMedia(suite.videoFeedPost)
 	expected := utils.Media{
-		VideoCid:  "bafkreiawmtb3mxmfcwuf4w4cmun6gjgrj3ktv5zpsq2gwtos2nkjaenqqe",
-		MediaType: "mp4",
+		Items: []utils.MediaItem{
+			{
+				Kind:        utils.MediaVideo,
+				Cid:         "bafkreiawmtb3mxmfcwuf4w4cmun6gjgrj3ktv5zpsq2gwtos2nkjaenqqe",
+				MimeType:    "video/mp4",
+				Alt:         "A cat knocking a glass off a table",
+				AspectRatio: &utils.AspectRatio{Width: 576, Height: 1024},
+			},
+			{
+				Kind:     utils.MediaCaption,
+				Cid:      "bafkreidtiih5ybttav26bc4kbg23hasob4vj2loxijsame2jb3z2xlbl2a",
+				MimeType: "text/vtt",
+				Lang:     "en",
+			},
+		},
 	}
 
 	suite.Assert().Equal(expected, *res)
+	suite.Assert().Equal("vtt", res.Items[1].Ext())
 }
 
 func (suite *UtilsTestSuite) TestExtractMedia_QuoteImage() {
 	res := utils.ExtractMedia(suite.quoteImageFeedPost)
 	expected := utils.Media{
-		ImageCid:  []string{"bafkreig3gejydod7xpuwd2bwtkkl2v3537raudjzhy2exqzqhzchuu6zlu"},
-		MediaType: "jpeg",
+		Items: []utils.MediaItem{{
+			Kind:        utils.MediaImage,
+			Cid:         "bafkreig3gejydod7xpuwd2bwtkkl2v3537raudjzhy2exqzqhzchuu6zlu",
+			MimeType:    "image/jpeg",
+			Alt:         "A man standing in the desert early morning wearing noise canceling headphones, aviator sunglasses and a blue Nike tech fleece ",
+			AspectRatio: &utils.AspectRatio{Width: 1126, Height: 1998},
+		}},
 	}
 
 	suite.Assert().Equal(expected, *res)
@@ -176,25 +364,148 @@ func (suite *UtilsTestSuite) TestExtractMedia_QuoteImage() {
 
 func (suite *UtilsTestSuite) TestResolveHandle_Success() {
 	mockHandleResolver := &MockHandleResolver{}
-	expected := &atproto.IdentityResolveHandle_Output{}
-	mockHandleResolver.On("IdentityResolveHandle", mock.Anything, mock.Anything, mock.Anything).Return(&atproto.IdentityResolveHandle_Output{}, nil)
-	res, err := utils.ResolveHandle(mockHandleResolver, suite.mockHandle)
+	mockDIDResolver := &MockDIDResolver{}
+	doc := &identity.DIDDocument{DID: "did:plc:example", AlsoKnownAs: []string{"at://example.test"}}
+	mockHandleResolver.On("ResolveHandle", mock.Anything, syntax.Handle("example.test")).Return(syntax.DID("did:plc:example"), nil)
+	mockDIDResolver.On("ResolveDID", mock.Anything, syntax.DID("did:plc:example")).Return(doc, nil)
+	res, err := utils.ResolveHandle(mockHandleResolver, mockDIDResolver, "@Example.Test")
 
 	suite.Assert().Nil(err)
-	suite.Assert().Equal(expected, res)
+	suite.Assert().Equal("did:plc:example", res)
 	mockHandleResolver.AssertExpectations(suite.T())
+	mockDIDResolver.AssertExpectations(suite.T())
+}
+
+func (suite *UtilsTestSuite) TestResolveHandle_Raw_DID() {
+	mockHandleResolver := &MockHandleResolver{}
+	mockDIDResolver := &MockDIDResolver{}
+	res, err := utils.ResolveHandle(mockHandleResolver, mockDIDResolver, "did:plc:example")
+
+	suite.Assert().Nil(err)
+	suite.Assert().Equal("did:plc:example", res)
+	mockHandleResolver.AssertNotCalled(suite.T(), "ResolveHandle", mock.Anything, mock.Anything)
+	mockDIDResolver.AssertNotCalled(suite.T(), "ResolveDID", mock.Anything, mock.Anything)
 }
 
 func (suite *UtilsTestSuite) TestResolveHandle_Failure() {
 	mockHandleResolver := &MockHandleResolver{}
-	mockHandleResolver.On("IdentityResolveHandle", mock.Anything, mock.Anything, mock.Anything).Return((*atproto.IdentityResolveHandle_Output)(nil), errors.New(""))
-	res, err := utils.ResolveHandle(mockHandleResolver, suite.mockHandle)
+	mockDIDResolver := &MockDIDResolver{}
+	mockHandleResolver.On("ResolveHandle", mock.Anything, mock.Anything).Return(syntax.DID(""), errors.New(""))
+	res, err := utils.ResolveHandle(mockHandleResolver, mockDIDResolver, "example.test")
 
-	suite.Assert().Nil(res)
+	suite.Assert().Equal("", res)
 	suite.Assert().Error(err)
 	mockHandleResolver.AssertExpectations(suite.T())
 }
 
+func (suite *UtilsTestSuite) TestResolveHandle_Failure_Undeclared_Handle() {
+	mockHandleResolver := &MockHandleResolver{}
+	mockDIDResolver := &MockDIDResolver{}
+	doc := &identity.DIDDocument{DID: "did:plc:example", AlsoKnownAs: []string{"at://someone-else.test"}}
+	mockHandleResolver.On("ResolveHandle", mock.Anything, syntax.Handle("example.test")).Return(syntax.DID("did:plc:example"), nil)
+	mockDIDResolver.On("ResolveDID", mock.Anything, syntax.DID("did:plc:example")).Return(doc, nil)
+	res, err := utils.ResolveHandle(mockHandleResolver, mockDIDResolver, "example.test")
+
+	suite.Assert().Equal("", res)
+	suite.Assert().Error(err)
+}
+
+func (suite *UtilsTestSuite) TestDefaultHandleResolver_DNS() {
+	dnsAddress := serveDNS(suite.T(), map[string][]string{
+		"_atproto.example.test.": {"did=did:plc:example"},
+	})
+	client := &utils.DefaultHandleResolver{DNSResolver: localResolver(dnsAddress)}
+	res, err := client.ResolveHandle(context.Background(), "example.test")
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(syntax.DID("did:plc:example"), res)
+}
+
+func (suite *UtilsTestSuite) TestDefaultHandleResolver_Well_Known() {
+	dnsAddress := serveDNS(suite.T(), map[string][]string{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Assert().Equal("example.com", r.Host)
+		suite.Assert().Equal("/.well-known/atproto-did", r.URL.Path)
+		fmt.Fprintln(w, "did:plc:example")
+	}))
+	defer server.Close()
+
+	httpClient := server.Client()
+	transport := httpClient.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	client := &utils.DefaultHandleResolver{DNSResolver: localResolver(dnsAddress), HTTPClient: httpClient}
+	res, err := client.ResolveHandle(context.Background(), "example.com")
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(syntax.DID("did:plc:example"), res)
+}
+
+func (suite *UtilsTestSuite) TestDefaultHandleResolver_Failure_Not_Found() {
+	dnsAddress := serveDNS(suite.T(), map[string][]string{})
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	httpClient := server.Client()
+	transport := httpClient.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	client := &utils.DefaultHandleResolver{DNSResolver: localResolver(dnsAddress), HTTPClient: httpClient}
+	res, err := client.ResolveHandle(context.Background(), "example.com")
+
+	suite.Assert().ErrorIs(err, utils.ErrHandleNotFound)
+	suite.Assert().Equal(syntax.DID(""), res)
+}
+
+func localResolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", address)
+		},
+	}
+}
+
+func serveDNS(t *testing.T, records map[string][]string) string {
+	con, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { con.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := con.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			end := 12
+			var name strings.Builder
+			for end < n && query[end] != 0 {
+				length := int(query[end])
+				name.WriteString(string(query[end+1:end+1+length]) + ".")
+				end += length + 1
+			}
+			end += 5
+
+			answers := records[strings.ToLower(name.String())]
+			res := append([]byte{}, query[:2]...)
+			res = append(res, 0x81, 0x80, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0)
+			res = append(res, query[12:end]...)
+			for _, answer := range answers {
+				res = append(res, 0xc0, 0x0c, 0, 16, 0, 1, 0, 0, 0, 60, 0, byte(len(answer)+1), byte(len(answer)))
+				res = append(res, answer...)
+			}
+			con.WriteTo(res, addr)
+		}
+	}()
+	return con.LocalAddr().String()
+}
+
 func (suite *UtilsTestSuite) TestFindExpression_Success() {
 	mockRegex := `[^/]*$`
 	mockStr := "hello/world"
@@ -213,20 +524,28 @@ func (suite *UtilsTestSuite) TestFindExpression_Failure() {
 	suite.Assert().Equal("", res)
 }
 
+func tempPath(path string) any {
+	return mock.MatchedBy(func(name string) bool {
+		return filepath.Dir(name) == filepath.Dir(path) && strings.HasPrefix(filepath.Base(name), utils.TempPrefix) && strings.HasSuffix(name, utils.TempSuffix)
+	})
+}
+
 func (suite *UtilsTestSuite) TestWriteFile_Success() {
 	mockFS := &MockFileSystem{}
 	mockFile := &MockFile{}
 	mockFile.On("Write", mock.Anything).Return(len([]byte("test data")), nil)
+	mockFile.On("Sync").Return(nil)
 	mockFile.On("Close").Return(nil)
-	mockFS.On("OpenFile", "testfile.txt", os.O_CREATE|os.O_WRONLY, os.FileMode(0644)).Return(mockFile, nil)
+	mockFS.On("OpenFile", tempPath("testfile.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644)).Return(mockFile, nil)
+	mockFS.On("Rename", tempPath("testfile.txt"), "testfile.txt").Return(nil)
 
 	data := []byte("test data")
-	err := utils.WriteFile(mockFS, "testfile.txt", &data)
+	_, err := utils.WriteFile(mockFS, "testfile.txt", &data)
 
 	suite.Assert().NoError(err)
 	mockFile.AssertCalled(suite.T(), "Write", data)
 	mockFile.AssertCalled(suite.T(), "Close")
-	mockFS.AssertCalled(suite.T(), "OpenFile", "testfile.txt", os.O_CREATE|os.O_WRONLY, os.FileMode(0644))
+	mockFS.AssertCalled(suite.T(), "OpenFile", tempPath("testfile.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644))
 
 	mockFile.AssertExpectations(suite.T())
 	mockFS.AssertExpectations(suite.T())
@@ -237,15 +556,16 @@ func (suite *UtilsTestSuite) TestWriteFile_Failure_Write() {
 	mockFile := &MockFile{}
 	mockFile.On("Write", mock.Anything).Return(0, errors.New(""))
 	mockFile.On("Close").Return(nil)
-	mockFS.On("OpenFile", "testfile.txt", os.O_CREATE|os.O_WRONLY, os.FileMode(0644)).Return(mockFile, nil)
+	mockFS.On("OpenFile", tempPath("testfile.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644)).Return(mockFile, nil)
+	mockFS.On("Remove", tempPath("testfile.txt")).Return(nil)
 
 	data := []byte("test data")
-	err := utils.WriteFile(mockFS, "testfile.txt", &data)
+	_, err := utils.WriteFile(mockFS, "testfile.txt", &data)
 
 	suite.Assert().Error(err)
 	mockFile.AssertCalled(suite.T(), "Write", data)
 	mockFile.AssertCalled(suite.T(), "Close")
-	mockFS.AssertCalled(suite.T(), "OpenFile", "testfile.txt", os.O_CREATE|os.O_WRONLY, os.FileMode(0644))
+	mockFS.AssertNotCalled(suite.T(), "Rename", mock.Anything, mock.Anything)
 
 	mockFile.AssertExpectations(suite.T())
 	mockFS.AssertExpectations(suite.T())
@@ -255,12 +575,224 @@ func (suite *UtilsTestSuite) TestWriteFile_Failure_Open() {
 	mockFS := &MockFileSystem{}
 	mockFile := &MockFile{}
 
-	mockFS.On("OpenFile", "testfile.txt", os.O_CREATE|os.O_WRONLY, os.FileMode(0644)).Return(mockFile, errors.New(""))
+	mockFS.On("OpenFile", tempPath("testfile.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644)).Return(mockFile, errors.New(""))
 
 	data := []byte("test data")
-	err := utils.WriteFile(mockFS, "testfile.txt", &data)
+	_, err := utils.WriteFile(mockFS, "testfile.txt", &data)
 
 	suite.Assert().Error(err)
-	mockFS.AssertCalled(suite.T(), "OpenFile", "testfile.txt", os.O_CREATE|os.O_WRONLY, os.FileMode(0644))
+	mockFS.AssertCalled(suite.T(), "OpenFile", tempPath("testfile.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644))
 	mockFS.AssertExpectations(suite.T())
 }
+
+func (suite *UtilsTestSuite) TestWriteFile_Truncates_Shorter_Rewrite() {
+	path := filepath.Join(suite.T().TempDir(), "post.json")
+	long, short := []byte(`{"text":"a much longer post"}`), []byte(`{"text":"short"}`)
+
+	_, err := utils.WriteFile(&utils.DefaultFileSystem{}, path, &long)
+	suite.Require().NoError(err)
+	_, err = utils.WriteFile(&utils.DefaultFileSystem{}, path, &short)
+	suite.Require().NoError(err)
+
+	data, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(short, data)
+	leftovers, err := filepath.Glob(filepath.Join(filepath.Dir(path), utils.TempPrefix+"*"+utils.TempSuffix))
+	suite.Require().NoError(err)
+	suite.Assert().Empty(leftovers)
+}
+
+func (suite *UtilsTestSuite) TestWriteFile_Conflict_Policies() {
+	cases := map[utils.ConflictPolicy]map[string]string{
+		utils.ConflictSkip:      {"post.json": "first"},
+		utils.ConflictOverwrite: {"post.json": "third"},
+		utils.ConflictSuffix:    {"post.json": "first", "post-1.json": "second", "post-2.json": "third"},
+		utils.ConflictVersion:   {"post.json": "third", "post.v1.json": "first", "post.v2.json": "second"},
+	}
+	written := map[utils.ConflictPolicy][]string{
+		utils.ConflictSkip:      {"post.json", "post.json", "post.json"},
+		utils.ConflictOverwrite: {"post.json", "post.json", "post.json"},
+		utils.ConflictSuffix:    {"post.json", "post-1.json", "post-2.json"},
+		utils.ConflictVersion:   {"post.json", "post.json", "post.json"},
+	}
+	for policy, expected := range cases {
+		FSClient := &utils.DefaultFileSystem{OnConflict: policy}
+		directory := suite.T().TempDir()
+		var paths []string
+		for _, content := range []string{"first", "second", "third"} {
+			data := []byte(content)
+			path, err := utils.WriteFile(FSClient, filepath.Join(directory, "post.json"), &data)
+			suite.Require().NoError(err)
+			paths = append(paths, filepath.Base(path))
+		}
+		suite.Assert().Equal(written[policy], paths, string(policy))
+
+		entries, err := os.ReadDir(directory)
+		suite.Require().NoError(err)
+		files := map[string]string{}
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(directory, entry.Name()))
+			suite.Require().NoError(err)
+			files[entry.Name()] = string(data)
+		}
+		suite.Assert().Equal(expected, files, string(policy))
+	}
+}
+
+func (suite *UtilsTestSuite) TestParseConflictPolicy() {
+	policy, err := utils.ParseConflictPolicy("version")
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(utils.ConflictVersion, policy)
+
+	_, err = utils.ParseConflictPolicy("clobber")
+	suite.Assert().Error(err)
+}
+
+func (suite *UtilsTestSuite) TestQuarantineFile_Keeps_Earlier_Copies() {
+	path := filepath.Join(suite.T().TempDir(), "blob.jpeg")
+	fs := &utils.DefaultFileSystem{}
+
+	suite.Require().NoError(os.WriteFile(path, []byte("first"), 0644))
+	first, err := utils.QuarantineFile(fs, path)
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.WriteFile(path, []byte("second"), 0644))
+	second, err := utils.QuarantineFile(fs, path)
+	suite.Require().NoError(err)
+
+	suite.Assert().Equal(utils.QuarantinePath(path), first)
+	suite.Assert().NotEqual(first, second)
+	data, err := os.ReadFile(first)
+	suite.Require().NoError(err)
+	suite.Assert().Equal("first", string(data))
+	data, err = os.ReadFile(second)
+	suite.Require().NoError(err)
+	suite.Assert().Equal("second", string(data))
+}
+
+func (suite *UtilsTestSuite) TestReadHandlesFile_Success() {
+	path := filepath.Join(suite.T().TempDir(), "handles.txt")
+	suite.Require().NoError(os.WriteFile(path, []byte("# accounts\nbsky.app\n\n  jay.bsky.team  \n"), 0644))
+
+	res, err := utils.ReadHandlesFile(path)
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal([]string{"bsky.app", "jay.bsky.team"}, res)
+}
+
+func (suite *UtilsTestSuite) TestReadHandlesFile_Failure_Missing() {
+	res, err := utils.ReadHandlesFile(filepath.Join(suite.T().TempDir(), "handles.txt"))
+
+	suite.Assert().Error(err)
+	suite.Assert().Nil(res)
+}
+
+const mockDIDDocument = `{"id":"%s","alsoKnownAs":["at://example.test"],"service":[{"id":"#atproto_pds","type":"AtprotoPersonalDataServer","serviceEndpoint":"https://pds.example"}]}`
+
+func (suite *UtilsTestSuite) TestDefaultDIDResolver_PLC() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Assert().Equal("/did:plc:example", r.URL.Path)
+		fmt.Fprintf(w, mockDIDDocument, "did:plc:example")
+	}))
+	defer server.Close()
+
+	resolver := &utils.DefaultDIDResolver{PLCURL: server.URL}
+	res, err := utils.NewPDSCache(resolver, time.Minute).PDS(context.Background(), "did:plc:example")
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal("https://pds.example", res)
+}
+
+func (suite *UtilsTestSuite) TestDefaultDIDResolver_Web() {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Assert().Equal("/.well-known/did.json", r.URL.Path)
+		fmt.Fprintf(w, mockDIDDocument, "did:web:example")
+	}))
+	defer server.Close()
+
+	host := strings.ReplaceAll(strings.TrimPrefix(server.URL, "https://"), ":", "%3A")
+	resolver := &utils.DefaultDIDResolver{HTTPClient: server.Client()}
+	res, err := utils.NewPDSCache(resolver, time.Minute).PDS(context.Background(), "did:web:"+host)
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal("https://pds.example", res)
+}
+
+func (suite *UtilsTestSuite) TestDefaultDIDResolver_Failure_Not_Found() {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	resolver := &utils.DefaultDIDResolver{PLCURL: server.URL}
+	res, err := utils.NewPDSCache(resolver, time.Minute).PDS(context.Background(), "did:plc:example")
+
+	suite.Assert().Error(err)
+	suite.Assert().Equal("", res)
+}
+
+func (suite *UtilsTestSuite) TestPDSCache_Caches_Until_TTL() {
+	mockDIDResolver := &MockDIDResolver{}
+	doc := &identity.DIDDocument{
+		DID: "did:plc:example",
+		Service: []identity.DocService{
+			{ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: "https://pds.example"},
+		},
+	}
+	mockDIDResolver.On("ResolveDID", mock.Anything, syntax.DID("did:plc:example")).Return(doc, nil)
+
+	cache := utils.NewPDSCache(mockDIDResolver, time.Hour)
+	first, err := cache.PDS(context.Background(), "did:plc:example")
+	suite.Require().NoError(err)
+	second, err := cache.PDS(context.Background(), "did:plc:example")
+	suite.Require().NoError(err)
+
+	suite.Assert().Equal("https://pds.example", first)
+	suite.Assert().Equal(first, second)
+	mockDIDResolver.AssertNumberOfCalls(suite.T(), "ResolveDID", 1)
+
+	expired := utils.NewPDSCache(mockDIDResolver, 0)
+	_, _ = expired.PDS(context.Background(), "did:plc:example")
+	_, _ = expired.PDS(context.Background(), "did:plc:example")
+
+	mockDIDResolver.AssertNumberOfCalls(suite.T(), "ResolveDID", 3)
+}
+
+func (suite *UtilsTestSuite) TestDefaultIdentityResolver_Verified_Handle() {
+	mockHandleResolver := &MockHandleResolver{}
+	mockDIDResolver := &MockDIDResolver{}
+	doc := &identity.DIDDocument{DID: "did:plc:example", AlsoKnownAs: []string{"at://New.Example"}}
+	mockDIDResolver.On("ResolveDID", mock.Anything, syntax.DID("did:plc:example")).Return(doc, nil)
+	mockHandleResolver.On("ResolveHandle", mock.Anything, syntax.Handle("new.example")).Return(syntax.DID("did:plc:example"), nil)
+
+	resolver := &utils.DefaultIdentityResolver{Handles: mockHandleResolver, DIDs: mockDIDResolver}
+	res, err := resolver.ResolveIdentity(context.Background(), "did:plc:example")
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal("new.example", res)
+}
+
+func (suite *UtilsTestSuite) TestDefaultIdentityResolver_Invalid_Handle() {
+	mockHandleResolver := &MockHandleResolver{}
+	mockDIDResolver := &MockDIDResolver{}
+	doc := &identity.DIDDocument{DID: "did:plc:example", AlsoKnownAs: []string{"at://new.example"}}
+	mockDIDResolver.On("ResolveDID", mock.Anything, syntax.DID("did:plc:example")).Return(doc, nil)
+	mockHandleResolver.On("ResolveHandle", mock.Anything, syntax.Handle("new.example")).Return(syntax.DID("did:plc:someone-else"), nil)
+
+	resolver := &utils.DefaultIdentityResolver{Handles: mockHandleResolver, DIDs: mockDIDResolver}
+	res, err := resolver.ResolveIdentity(context.Background(), "did:plc:example")
+
+	suite.Assert().NoError(err)
+	suite.Assert().Equal(utils.InvalidHandle, res)
+}
+
+func (suite *UtilsTestSuite) TestDefaultIdentityResolver_Transient_Error() {
+	mockHandleResolver := &MockHandleResolver{}
+	mockDIDResolver := &MockDIDResolver{}
+	doc := &identity.DIDDocument{DID: "did:plc:example", AlsoKnownAs: []string{"at://new.example"}}
+	mockDIDResolver.On("ResolveDID", mock.Anything, syntax.DID("did:plc:example")).Return(doc, nil)
+	mockHandleResolver.On("ResolveHandle", mock.Anything, syntax.Handle("new.example")).Return(syntax.DID(""), errors.New("i/o timeout"))
+
+	resolver := &utils.DefaultIdentityResolver{Handles: mockHandleResolver, DIDs: mockDIDResolver}
+	res, err := resolver.ResolveIdentity(context.Background(), "did:plc:example")
+
+	suite.Assert().Error(err)
+	suite.Assert().Equal("", res)
+}